@@ -1,30 +1,243 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gasparian/clickhouse-test-file-reader/internal/io"
 	"github.com/gasparian/clickhouse-test-file-reader/internal/ranker"
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
 )
 
+// inputPaths returns paths passed as arguments; without arguments stdin is used
+// if it's piped, otherwise the path is asked interactively
+func inputPaths(args []string) ([]string, error) {
+	if len(args) > 0 {
+		return io.ParseInputPaths(args)
+	}
+	if io.IsStdinPiped() {
+		return []string{io.StdinPath}, nil
+	}
+	path, err := io.ParseInputPath()
+	if err != nil {
+		return nil, err
+	}
+	return []string{path}, nil
+}
+
+// printMalformed logs summary of the malformed lines with a few examples
+func printMalformed(stats *ranker.Stats) {
+	if stats == nil || stats.Malformed == 0 {
+		return
+	}
+	kinds := make([]string, 0, len(stats.MalformedByKind))
+	for kind, n := range stats.MalformedByKind {
+		kinds = append(kinds, fmt.Sprintf("%v: %v", kind, n))
+	}
+	sort.Strings(kinds)
+	log.Printf("Warning: %v malformed lines found (%v)\n", stats.Malformed, strings.Join(kinds, ", "))
+	for _, e := range stats.Examples {
+		log.Println("  ", e)
+	}
+}
+
+// printProgress rewrites the progress line on stderr
+func printProgress(p ranker.Progress) {
+	const mb = 1024 * 1024
+	line := fmt.Sprintf("%.1f MB, %.1f MB/s", float64(p.BytesDone)/mb, p.Rate()/mb)
+	if p.TotalBytes > 0 {
+		line = fmt.Sprintf("%.1f%% of %.1f MB, %.1f MB/s, ETA %v",
+			p.Percent(), float64(p.TotalBytes)/mb, p.Rate()/mb, p.ETA().Round(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, "\rProgress: %v, %v segments done\033[K", line, p.SegmentsDone)
+}
+
+// printWarnings logs adjustments of the options made by the ranker
+func printWarnings(stats *ranker.Stats) {
+	if stats == nil {
+		return
+	}
+	for _, warning := range stats.Warnings {
+		log.Println("Warning:", warning)
+	}
+}
+
+// printStats writes statistics of the run to stderr, either human-readable or as JSON
+func printStats(stats *ranker.Stats, format string) {
+	if stats == nil {
+		return
+	}
+	if format == "json" {
+		if err := json.NewEncoder(os.Stderr).Encode(stats); err != nil {
+			log.Println("Error: cannot encode stats:", err)
+		}
+		return
+	}
+	w := os.Stderr
+	fmt.Fprintf(w, "Lines:       %v (%v parsed, %v empty, %v malformed)\n", stats.Lines, stats.Parsed, stats.EmptyLines, stats.Malformed)
+	kinds := make([]string, 0, len(stats.MalformedByKind))
+	for kind := range stats.MalformedByKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %-10v %v\n", kind+":", stats.MalformedByKind[kind])
+	}
+	fmt.Fprintf(w, "Segments:    %v, %v bytes read\n", stats.Segments, stats.BytesRead)
+	for i, busy := range stats.WorkerBusy {
+		fmt.Fprintf(w, "Worker %-4v  %v busy\n", i+1, busy.Round(time.Microsecond))
+	}
+	fmt.Fprintf(w, "Merge time:  %v\n", stats.MergeTime.Round(time.Microsecond))
+	fmt.Fprintf(w, "Wall time:   %v\n", stats.WallTime.Round(time.Microsecond))
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [path ...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s serve [flags]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Paths may be glob patterns, `-` means reading from stdin.")
+		flag.PrintDefaults()
+	}
 	nWorkers := flag.Int("workers", 4, "number of workers to process lines")
 	topK := flag.Int("topk", 10, "number of top k elements to return")
-	bufSize := flag.Int("buf", 1024*1024, "size of buffer to read lines from file")
+	bufSize := flag.Int("buf", 1024*1024, "initial size of buffer to read lines from file, it grows for longer lines")
 	segmentSize := flag.Int64("segment", 2*1024*1024, "size of the file segment in bytes to be processed by a single worker")
+	withValues := flag.Bool("values", false, "print values next to the urls")
+	aggregateName := flag.String("aggregate", "none", "combine values of the same url before ranking: none, sum, count, max, min or mean")
+	maxGroups := flag.Int("maxgroups", 0, "max number of distinct urls kept in memory by a worker while aggregating, 0 means unbounded")
+	orderName := flag.String("order", "desc", "ranking direction: desc for top k highest values or asc for k lowest values")
+	tieBreakName := flag.String("ties", "first", "how equal values are ranked: first or last occurrence in the file first, or url in lexical order")
+	withTies := flag.Bool("withties", false, "include all records tied with the k-th value, even if more than k records are returned")
+	format := flag.String("format", "default", "format of the input lines: default, fields, tsv, csv or jsonl")
+	keyField := flag.String("key", "", "url field: column number (from 1) or header name for delimited formats, dot separated path for jsonl")
+	valueField := flag.String("value", "", "value field: column number (from 1) or header name for delimited formats, dot separated path for jsonl")
+	withHeader := flag.Bool("header", false, "first line of every input is a header of delimited format")
+	valueTypeName := flag.String("valuetype", "int", "type of values: int, float or decimal")
+	scale := flag.Int("scale", 2, "number of fractional digits of decimal values")
+	nanPolicyName := flag.String("nan", "reject", "how NaN and infinite float values are handled: reject them, or rank NaN as lowest or highest")
+	malformedName := flag.String("malformed", "count", "how malformed lines are handled: count, skip (without counting), fail or reject (write them to the rejects file)")
+	maxMalformed := flag.Int("maxmalformed", 0, "number of malformed lines tolerated before failing with `-malformed fail`")
+	rejectsPath := flag.String("rejects", "", "file to write malformed lines to with `-malformed reject`")
+	maxLineLen := flag.Int("maxline", 0, "max line length in bytes, longer lines are handled as malformed; 0 means no limit")
+	validate := flag.Bool("validate", false, "check that segments tile the input files exactly, for debugging")
+	retries := flag.Int("retries", 0, "number of times a failed segment is processed again before giving up")
+	mmap := flag.Bool("mmap", false, "map plain files into memory instead of reading every segment separately (Linux only)")
+	progress := flag.Bool("progress", false, "print progress to stderr: percentage of processed bytes, rate and ETA")
+	statsFormat := flag.String("stats", "", "print statistics of the run to stderr: line counts, segments and timings, as human or json")
+	delimiterStr := flag.String("delimiter", `\n`, "line `delimiter`, Go escape sequences like \\r\\n or \\x00 are supported; trailing \\r of lines is dropped with the default one")
 	flag.Parse()
 
-	path, _ := io.ParseInputPath()
-	res, err := ranker.ProcessFile(
-		path,
-		*bufSize,
-		*nWorkers,
-		*topK,
-		*segmentSize,
+	if *statsFormat != "" && *statsFormat != "human" && *statsFormat != "json" {
+		log.Fatalf("error: unknown stats format `%v`, should be human or json", *statsFormat)
+	}
+	aggregate, err := ranker.ParseAggregate(*aggregateName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	order, err := ranker.ParseOrder(*orderName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tieBreak, err := ranker.ParseTieBreak(*tieBreakName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	malformed, err := ranker.ParseMalformedPolicy(*malformedName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	valueType, err := record.ParseValueType(*valueTypeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	nanPolicy, err := record.ParseNaNPolicy(*nanPolicyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	delimiter, err := io.ParseDelimiter(*delimiterStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	values := record.ValueFormat{Type: valueType, Scale: *scale, NaN: nanPolicy}
+	parser, err := record.NewParser(*format, record.ParserOptions{
+		Key:    *keyField,
+		Value:  *valueField,
+		Header: *withHeader,
+		Values: values,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	paths, err := inputPaths(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	// signals are caught only after the path has been entered,
+	// so the interactive prompt still can be interrupted as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var onProgress func(ranker.Progress)
+	if *progress {
+		onProgress = printProgress
+	}
+	res, stats, err := ranker.ProcessFilesStats(
+		ctx,
+		paths,
+		ranker.Options{
+			BufSize:          *bufSize,
+			NWorkers:         *nWorkers,
+			TopK:             *topK,
+			SegmentSize:      *segmentSize,
+			Aggregate:        aggregate,
+			MaxGroups:        *maxGroups,
+			Order:            order,
+			TieBreak:         tieBreak,
+			IncludeTies:      *withTies,
+			Values:           values,
+			Parser:           parser,
+			Malformed:        malformed,
+			MaxMalformed:     *maxMalformed,
+			RejectsPath:      *rejectsPath,
+			Retries:          *retries,
+			MaxLineLen:       *maxLineLen,
+			ValidateSegments: *validate,
+			Delimiter:        delimiter,
+			Mmap:             *mmap,
+			OnProgress:       onProgress,
+		},
 	)
+	if *progress {
+		fmt.Fprintln(os.Stderr)
+	}
+	printWarnings(stats)
+	printMalformed(stats)
+	if *statsFormat != "" {
+		printStats(stats, *statsFormat)
+	}
+	if errors.Is(err, context.Canceled) {
+		stop()
+		log.Println("Interrupted")
+		os.Exit(130)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	io.PrintResult(res)
+	io.PrintRecords(res, *withValues, values)
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/server"
+)
+
+// serve runs the HTTP server ranking files of the submitted jobs until it's interrupted
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s serve [flags]\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "Jobs are submitted by POST /jobs, see README for the API.")
+		flags.PrintDefaults()
+	}
+	addr := flags.String("addr", ":8080", "address to listen on")
+	maxJobs := flags.Int("maxjobs", 2, "max number of jobs processed simultaneously, other jobs are queued")
+	maxUpload := flags.Int64("maxupload", server.DefaultMaxUpload, "max size of the uploaded input in bytes")
+	jobTTL := flags.Duration("jobttl", server.DefaultJobTTL, "how long finished jobs are kept before they're forgotten")
+	uploadDir := flags.String("uploads", "", "directory to keep uploaded inputs while they're processed, the temp dir by default")
+	root := flags.String("root", "", "directory with server-local inputs which can be ranked by path, disabled if empty")
+	flags.Parse(args)
+
+	s := server.New(server.Config{
+		MaxJobs:   *maxJobs,
+		MaxUpload: *maxUpload,
+		JobTTL:    *jobTTL,
+		UploadDir: *uploadDir,
+		Root:      *root,
+	})
+	srv := &http.Server{Addr: *addr, Handler: s}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	log.Printf("Listening on %v\n", *addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	// unfinished jobs are cancelled
+	s.Close()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/gasparian/clickhouse-test-file-reader/internal/ranker"
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
 )
 
 var (
@@ -47,14 +49,56 @@ func createTempFile(nLines int) (string, string, error) {
 	return f.Name(), maxValUrl, nil
 }
 
-func processFile(fname string, topK, buffSize, nworkers int, segmentSize int64) (int64, []string) {
-	start := time.Now()
-	rank, err := ranker.ProcessFile(fname, buffSize, nworkers, topK, segmentSize)
-	duration := time.Since(start)
+// processFile returns the ranked records along with statistics of the run, which hold its timings
+func processFile(fname string, topK, buffSize, nworkers int, segmentSize int64, mmap bool) (*ranker.Stats, []record.Record) {
+	rank, stats, err := ranker.ProcessFilesStats(context.Background(), []string{fname}, ranker.Options{
+		BufSize:     buffSize,
+		NWorkers:    nworkers,
+		TopK:        topK,
+		SegmentSize: segmentSize,
+		Mmap:        mmap,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	return int64(duration), rank
+	return stats, rank
+}
+
+// maxBusy returns the busy time of the most loaded worker
+func maxBusy(stats *ranker.Stats) time.Duration {
+	var busy time.Duration
+	for _, b := range stats.WorkerBusy {
+		if b > busy {
+			busy = b
+		}
+	}
+	return busy
+}
+
+// stringParser hides raw parsing of the default parser, so every line is converted to string before parsing
+type stringParser struct {
+	parser record.DefaultParser
+}
+
+func (p stringParser) Parse(line string) (record.Record, error) {
+	return p.parser.Parse(line)
+}
+
+// allocsPerLine returns amount of heap allocations per line of the single-worker run with the parser
+func allocsPerLine(fname string, nLines, topK, bufSize int, parser record.Parser) float64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := ranker.ProcessFileRecords(context.Background(), fname, ranker.Options{
+		BufSize:  bufSize,
+		NWorkers: 1,
+		TopK:     topK,
+		Parser:   parser,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	return float64(after.Mallocs-before.Mallocs) / float64(nLines)
 }
 
 func init() {
@@ -78,22 +122,52 @@ func main() {
 		log.Fatal(err)
 	}
 	defer os.RemoveAll(fname)
+	log.Printf("Allocations per line: %.3f parsing strings, %.3f parsing bytes\n",
+		allocsPerLine(fname, nLines, topK, bufSize, stringParser{}),
+		allocsPerLine(fname, nLines, topK, bufSize, record.DefaultParser{}))
+	// many small segments with large k stress merging of workers heaps
+	fi, err := os.Stat(fname)
+	if err != nil {
+		log.Fatal(err)
+	}
+	manySegmentsSize := fi.Size() / 10000
+	manySegmentsTopK := 1000
+	for j := 0; j <= 3; j++ {
+		nWorkers := int(math.Pow(2, float64(j)))
+		stats, rank := processFile(fname, manySegmentsTopK, 4096, nWorkers, manySegmentsSize, false)
+		if len(rank) != manySegmentsTopK || rank[0].Url != maxValUrl {
+			log.Fatalf("%s should be top record of %v, but got %v records\n", maxValUrl, manySegmentsTopK, len(rank))
+		}
+		log.Printf("10k segments, top %v, %v workers: %v ms (max worker busy %v ms, merge %v ms)\n", manySegmentsTopK, nWorkers,
+			stats.WallTime.Milliseconds(), maxBusy(stats).Milliseconds(), stats.MergeTime.Milliseconds())
+	}
+	// segments are read from the file by every worker or sliced from the file mapped once
+	readModes := []bool{false}
+	if runtime.GOOS == "linux" {
+		readModes = append(readModes, true)
+	}
 	for i := 0; i <= 4; i += 2 {
 		segmentSize := int64(math.Pow(2, float64(i))) * defaultSegmentSize
 		log.Printf("--- Segment size: %v b\n", segmentSize)
 		for j := 0; j <= 3; j++ {
 			nWorkers := math.Pow(2, float64(j))
-			avrgDuration = 0
 			log.Printf(">>> %v workers \n", nWorkers)
-			for k := 0; k < nRuns; k++ {
-				duration, rank := processFile(fname, topK, bufSize, int(nWorkers), segmentSize)
-				if rank[0] != maxValUrl {
-					log.Fatalf("%s should be top record, but got %s\n", maxValUrl, rank[0])
+			for _, mmap := range readModes {
+				avrgDuration = 0
+				for k := 0; k < nRuns; k++ {
+					stats, rank := processFile(fname, topK, bufSize, int(nWorkers), segmentSize, mmap)
+					if rank[0].Url != maxValUrl {
+						log.Fatalf("%s should be top record, but got %s\n", maxValUrl, rank[0].Url)
+					}
+					avrgDuration += float64(stats.WallTime) / 1e6
+				}
+				avrgDuration /= float64(nRuns)
+				mode := "read"
+				if mmap {
+					mode = "mmap"
 				}
-				avrgDuration += float64(duration) / 1e6
+				log.Printf("Average elapsed time (%v): %v ms\n", mode, int(avrgDuration))
 			}
-			avrgDuration /= float64(nRuns)
-			log.Printf("Average elapsed time: %v ms\n", int(avrgDuration))
 			log.Println("---------------------")
 		}
 		log.Println()
@@ -0,0 +1,259 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// BGZFRange describes position of the BGZF segment in the uncompressed data;
+// segment owns all lines which start inside the range, so the last line can end
+// in the blocks of the next segment
+type BGZFRange struct {
+	// PrevBlock is a compressed offset of the last non-empty block before the segment,
+	// its last byte shows whether the first line starts right at the segment start; -1 for the first segment
+	PrevBlock int64
+	Start     int64
+	Len       int64
+}
+
+const bgzfFixedHeaderLen = 12
+
+// parseBGZFHeader returns the total size of the BGZF block from its header;
+// header should contain the whole gzip extra field
+func parseBGZFHeader(header []byte) (int64, bool) {
+	const flagExtra = 1 << 2
+	if len(header) < bgzfFixedHeaderLen || header[0] != gzipMagic[0] || header[1] != gzipMagic[1] ||
+		header[2] != 8 || header[3]&flagExtra == 0 {
+		return 0, false
+	}
+	xlen := int(binary.LittleEndian.Uint16(header[10:12]))
+	if len(header) < bgzfFixedHeaderLen+xlen {
+		return 0, false
+	}
+	extra := header[bgzfFixedHeaderLen : bgzfFixedHeaderLen+xlen]
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if len(extra) < 4+slen {
+			break
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 {
+			return int64(binary.LittleEndian.Uint16(extra[4:6])) + 1, true
+		}
+		extra = extra[4+slen:]
+	}
+	return 0, false
+}
+
+// readBGZFBlock returns compressed and uncompressed sizes of the block which starts at `offset`
+func readBGZFBlock(f io.ReaderAt, offset int64) (int64, int64, error) {
+	header := make([]byte, bgzfFixedHeaderLen)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return 0, 0, fmt.Errorf("error: cannot read BGZF block header at %v: %w", offset, err)
+	}
+	xlen := int(binary.LittleEndian.Uint16(header[10:12]))
+	header = append(header, make([]byte, xlen)...)
+	if _, err := f.ReadAt(header[bgzfFixedHeaderLen:], offset+bgzfFixedHeaderLen); err != nil {
+		return 0, 0, fmt.Errorf("error: cannot read BGZF block header at %v: %w", offset, err)
+	}
+	blockSize, ok := parseBGZFHeader(header)
+	if !ok {
+		return 0, 0, fmt.Errorf("error: invalid BGZF block header at %v", offset)
+	}
+	isize := make([]byte, 4)
+	if _, err := f.ReadAt(isize, offset+blockSize-4); err != nil {
+		return 0, 0, fmt.Errorf("error: cannot read BGZF block trailer at %v: %w", offset, err)
+	}
+	return blockSize, int64(binary.LittleEndian.Uint32(isize)), nil
+}
+
+// GetBGZFSegments walks through the BGZF block headers and returns channel with segments
+// made of whole blocks of ~`segmentSize` compressed bytes; no data is decompressed here
+func GetBGZFSegments(ctx context.Context, fpath string, bufSize int, segmentSize int64) (*Segments, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fsize := fi.Size()
+	if segmentSize <= 0 {
+		segmentSize = fsize
+	}
+	segments := &Segments{C: make(chan FileSegmentPointer)}
+	go func() {
+		defer f.Close()
+		defer close(segments.C)
+		var (
+			offset    int64 = 0
+			uOffset   int64 = 0
+			prevBlock int64 = -1
+			lastBlock int64 = -1
+		)
+		segment := newBGZFSegment(fpath, bufSize, offset, uOffset, prevBlock)
+		for offset < fsize {
+			blockSize, uSize, err := readBGZFBlock(f, offset)
+			if err != nil {
+				segments.err = err
+				return
+			}
+			if uSize > 0 {
+				lastBlock = offset
+			}
+			offset += blockSize
+			uOffset += uSize
+			segment.Len = offset - segment.Start
+			segment.BGZF.Len = uOffset - segment.BGZF.Start
+			if segment.Len >= segmentSize || offset >= fsize {
+				if segment.BGZF.Len > 0 {
+					select {
+					case segments.C <- segment:
+					case <-ctx.Done():
+						return
+					}
+				}
+				prevBlock = lastBlock
+				segment = newBGZFSegment(fpath, bufSize, offset, uOffset, prevBlock)
+			}
+		}
+	}()
+	return segments, nil
+}
+
+func newBGZFSegment(fpath string, bufSize int, start, uStart, prevBlock int64) FileSegmentPointer {
+	return FileSegmentPointer{
+		Fpath:   fpath,
+		BufSize: bufSize,
+		Start:   start,
+		BGZF: &BGZFRange{
+			PrevBlock: prevBlock,
+			Start:     uStart,
+		},
+	}
+}
+
+// openBGZFSegment returns reader of the lines owned by the segment
+// and the uncompressed offset of the first returned byte
+func openBGZFSegment(f *os.File, segment FileSegmentPointer, delimiter byte) (io.Reader, int64, error) {
+	rng := segment.BGZF
+	skipPartial := false
+	if rng.PrevBlock >= 0 {
+		last, err := lastBlockByte(f, rng.PrevBlock)
+		if err != nil {
+			return nil, 0, err
+		}
+		// segment starts in the middle of the line, which belongs to the previous segment
+		skipPartial = last != delimiter
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(f, segment.Start, math.MaxInt64-segment.Start)))
+	if err != nil {
+		return nil, 0, err
+	}
+	r := bufio.NewReader(gz)
+	pos := rng.Start
+	end := rng.Start + rng.Len
+	if skipPartial {
+		for {
+			chunk, err := r.ReadSlice(delimiter)
+			pos += int64(len(chunk))
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF {
+				return bytes.NewReader(nil), pos, nil
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			break
+		}
+	}
+	if pos >= end {
+		// the only line started in the segment belongs to the previous one
+		return bytes.NewReader(nil), pos, nil
+	}
+	return &lineRangeReader{r: r, pos: pos, end: end, delimiter: delimiter}, pos, nil
+}
+
+// lastBlockByte decompresses the single block and returns its last byte
+func lastBlockByte(f *os.File, offset int64) (byte, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(f, offset, math.MaxInt64-offset)))
+	if err != nil {
+		return 0, err
+	}
+	gz.Multistream(false)
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 0, fmt.Errorf("error: BGZF block at %v is empty", offset)
+	}
+	return data[len(data)-1], nil
+}
+
+// lineRangeReader reads data till the `end` position,
+// then continues till the end of the line which started before it
+type lineRangeReader struct {
+	r         *bufio.Reader
+	pos       int64
+	end       int64
+	delimiter byte
+	last      byte
+	done      bool
+}
+
+func (r *lineRangeReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	if r.pos < r.end {
+		if int64(len(p)) > r.end-r.pos {
+			p = p[:r.end-r.pos]
+		}
+		n, err := r.r.Read(p)
+		if n > 0 {
+			r.pos += int64(n)
+			r.last = p[n-1]
+		}
+		if err == io.EOF {
+			r.done = true
+		}
+		return n, err
+	}
+	if r.last == r.delimiter {
+		r.done = true
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		b, err := r.r.ReadByte()
+		if err == io.EOF {
+			r.done = true
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		p[n] = b
+		n++
+		r.last = b
+		if b == r.delimiter {
+			r.done = true
+			break
+		}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
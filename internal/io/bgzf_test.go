@@ -0,0 +1,106 @@
+package io
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/testutil"
+)
+
+func TestParseBGZFHeader(t *testing.T) {
+	compressed := testutil.WriteBGZF(t, []byte("http://api.tech.com/item/121345  9\n"), 1024)
+	size, ok := parseBGZFHeader(compressed)
+	if !ok {
+		t.Fatal("BGZF header should be parsed")
+	}
+	blockSize, uSize, err := readBGZFBlock(bytes.NewReader(compressed), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != blockSize || uSize != 35 {
+		t.Fatalf("Wrong block sizes: %v, %v, %v", size, blockSize, uSize)
+	}
+	var plain bytes.Buffer
+	w := gzip.NewWriter(&plain)
+	w.Write([]byte("data"))
+	w.Close()
+	if _, ok := parseBGZFHeader(plain.Bytes()); ok {
+		t.Fatal("Plain gzip should not be detected as BGZF")
+	}
+}
+
+func TestGetBGZFSegments(t *testing.T) {
+	inputs := [][]byte{
+		[]byte(`
+http://api.tech.com/item/121345  9
+http://api.tech.com/item/122345  350
+http://api.tech.com/item/123345  25
+http://api.tech.com/item/124345  231
+http://api.tech.com/item/125345  111
+
+`),
+		[]byte(`http://api.tech.com/item/121345  9
+http://api.tech.com/item/122345  350
+http://api.tech.com/item/123345/with/a/very/long/path/which/spans/several/blocks  25`),
+	}
+	fpath := filepath.Join(t.TempDir(), "input.gz")
+	for _, data := range inputs {
+		for _, blockSize := range []int{1, 7, 35, 36, 37, 1000} {
+			err := os.WriteFile(fpath, testutil.WriteBGZF(t, data, blockSize), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, segmentSize := range []int64{0, 1, 50, 200} {
+				segments, err := GetBGZFSegments(context.Background(), fpath, 64, segmentSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				joined := make([]byte, 0, len(data))
+				for segment := range segments.C {
+					r, err := OpenSegment(segment, DefaultDelimiter)
+					if err != nil {
+						t.Fatal(err)
+					}
+					content, err := io.ReadAll(r)
+					r.Close()
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(content) > 0 && r.Offset != int64(len(joined)) {
+						t.Fatalf("Block %v, segment %v: offset should be %v, but got %v", blockSize, segmentSize, len(joined), r.Offset)
+					}
+					joined = append(joined, content...)
+				}
+				if segments.Err() != nil {
+					t.Fatal(segments.Err())
+				}
+				if !bytes.Equal(joined, data) {
+					t.Fatalf("Block %v, segment %v: segments do not cover the input exactly: `%s`", blockSize, segmentSize, joined)
+				}
+			}
+		}
+	}
+}
+
+func TestGetBGZFSegmentsCorrupted(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input.gz")
+	data := testutil.WriteBGZF(t, []byte("http://api.tech.com/item/121345  9\n"), 1024)
+	err := os.WriteFile(fpath, append(data, []byte("garbage")...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := GetBGZFSegments(context.Background(), fpath, 64, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range segments.C {
+	}
+	if segments.Err() == nil {
+		t.Fatal("Invalid block should be reported")
+	}
+}
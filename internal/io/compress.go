@@ -0,0 +1,139 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Compression is a compression format of the input
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	// CompressionGzip is a plain (possibly multi-member) gzip, which can only be read sequentially
+	CompressionGzip
+	// CompressionBGZF is a gzip made of independent blocks with sizes stored in their headers
+	// (as produced by `bgzip`), so it can be split into segments without decompression
+	CompressionBGZF
+	CompressionBzip2
+	CompressionZstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionBGZF:
+		return "bgzf"
+	case CompressionBzip2:
+		return "bzip2"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// ErrUnsupportedCompression is returned for the detected compression formats
+// which can't be decompressed with the standard library
+var ErrUnsupportedCompression = errors.New("error: unsupported compression format")
+
+// Validate returns an error if the format can't be decompressed
+func (c Compression) Validate() error {
+	switch c {
+	case CompressionNone, CompressionGzip, CompressionBGZF, CompressionBzip2:
+		return nil
+	}
+	return fmt.Errorf("%w: %v, decompress the input and pass it through stdin", ErrUnsupportedCompression, c)
+}
+
+// how many bytes of the header are needed to detect the compression format
+const compressionHeaderLen = 64
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// bzip2 stream starts with the block, or with the end of stream marker if it's empty
+	bzip2BlockMagic = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	bzip2EndMagic   = []byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+)
+
+// DetectCompression detects compression format by the magic bytes of the input header;
+// fixed fields following the magic are checked as well, so plain inputs which happen
+// to start with the same bytes are not misread as compressed
+func DetectCompression(header []byte) Compression {
+	switch {
+	case isGzipHeader(header):
+		if _, ok := parseBGZFHeader(header); ok {
+			return CompressionBGZF
+		}
+		return CompressionGzip
+	case isBzip2Header(header):
+		return CompressionBzip2
+	case bytes.HasPrefix(header, zstdMagic):
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// isGzipHeader checks the magic, the deflate compression method and that reserved flags are not set
+func isGzipHeader(header []byte) bool {
+	const reservedFlags = 0xe0
+	return len(header) >= 4 && bytes.HasPrefix(header, gzipMagic) && header[2] == 8 && header[3]&reservedFlags == 0
+}
+
+// isBzip2Header checks the magic, the block size level and the magic of the first block
+func isBzip2Header(header []byte) bool {
+	if len(header) < 10 || !bytes.HasPrefix(header, bzip2Magic) || header[3] < '1' || header[3] > '9' {
+		return false
+	}
+	block := header[4:10]
+	return bytes.Equal(block, bzip2BlockMagic) || bytes.Equal(block, bzip2EndMagic)
+}
+
+// PeekCompression detects compression format of the buffered reader without consuming its data
+func PeekCompression(r *bufio.Reader) Compression {
+	// error is ignored since the input could be shorter than the header
+	header, _ := r.Peek(compressionHeaderLen)
+	return DetectCompression(header)
+}
+
+// FileCompression detects compression format of the file
+func FileCompression(fpath string) (Compression, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return CompressionNone, err
+	}
+	defer f.Close()
+	header := make([]byte, compressionHeaderLen)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return CompressionNone, err
+	}
+	return DetectCompression(header[:n]), nil
+}
+
+// NewDecompressingReader wraps the reader with decompressor of the provided format;
+// BGZF is read as a regular multi-member gzip
+func NewDecompressingReader(r io.Reader, c Compression) (io.Reader, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c {
+	case CompressionNone:
+		return r, nil
+	case CompressionGzip, CompressionBGZF:
+		return gzip.NewReader(r)
+	case CompressionBzip2:
+		return bzip2.NewReader(r), nil
+	}
+	return r, nil
+}
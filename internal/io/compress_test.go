@@ -0,0 +1,70 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/testutil"
+)
+
+// bzip2 compressed sample urls stats data, since there is no bzip2 writer in the standard library
+var bzip2Data = []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xb4\xe0\x8b\x23\x00\x00\x01\x59\x80\x00\x10\x40\x01\xfe\x30\x2a\x62\xc4\x00\x20\x00\x68\x24\x49\x3d\x21\xa3\xd4\x00\x22\xa9\xb4\x6a\x00\x1a\x69\x2c\xc5\xf1\x93\x44\xa3\x94\x74\x8a\x47\x68\xd9\x0d\x17\xce\x9e\x92\x8a\xb1\x67\x0e\x1c\x16\xea\x62\xb6\xa4\x26\x55\x4a\x52\x3e\x4c\xd2\xe9\xe2\x60\x4f\x92\xe9\x29\x29\x29\x84\xb2\x4a\x61\x34\x4f\x52\x12\xe9\xf8\xbb\x92\x29\xc2\x84\x85\xa7\x04\x59\x18")
+
+func TestDetectCompression(t *testing.T) {
+	data := []byte("http://api.tech.com/item/121345  9\n")
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(data)
+	w.Close()
+	cases := []struct {
+		header []byte
+		gt     Compression
+	}{
+		{data, CompressionNone},
+		{[]byte{}, CompressionNone},
+		{gz.Bytes(), CompressionGzip},
+		{testutil.WriteBGZF(t, data, 1024), CompressionBGZF},
+		{bzip2Data, CompressionBzip2},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, CompressionZstd},
+		// plain inputs starting with the magic bytes
+		{[]byte("BZh_url  5\n"), CompressionNone},
+		{[]byte("BZh9 url  5\n"), CompressionNone},
+		{[]byte{0x1f, 0x8b, '_', 0x00, '\n'}, CompressionNone},
+		{[]byte{0x1f, 0x8b}, CompressionNone},
+	}
+	for _, c := range cases {
+		compression := DetectCompression(c.header)
+		if compression != c.gt {
+			t.Fatalf("Expected: %v, but got: %v\n", c.gt, compression)
+		}
+		r := bufio.NewReader(bytes.NewReader(c.header))
+		if PeekCompression(r) != c.gt {
+			t.Fatalf("Expected: %v, but got: %v\n", c.gt, compression)
+		}
+		if r.Buffered() != len(c.header) {
+			t.Fatal("Peeking should not consume the input")
+		}
+	}
+}
+
+func TestNewDecompressingReader(t *testing.T) {
+	r, err := NewDecompressingReader(bytes.NewReader(bzip2Data), CompressionBzip2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("http://api.tech.com/item/122345  350\n")) {
+		t.Fatalf("Wrong decompressed data: `%s`", data)
+	}
+	_, err = NewDecompressingReader(bytes.NewReader(nil), CompressionZstd)
+	if !errors.Is(err, ErrUnsupportedCompression) {
+		t.Fatalf("Expected `%v`, but got `%v`", ErrUnsupportedCompression, err)
+	}
+}
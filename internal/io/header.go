@@ -0,0 +1,47 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// PeekLine returns the first line of the buffered reader without consuming it;
+// the line should fit into the reader's buffer
+func PeekLine(r *bufio.Reader, delimiter []byte) (string, error) {
+	for n := 64; ; n *= 2 {
+		if n > r.Size() {
+			n = r.Size()
+		}
+		data, err := r.Peek(n)
+		if i := bytes.Index(data, delimiter); i >= 0 {
+			return string(TrimCR(data[:i], delimiter)), nil
+		}
+		if err == io.EOF {
+			return string(TrimCR(data, delimiter)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if n == r.Size() {
+			return "", fmt.Errorf("error: first line is longer than the buffer size %v", r.Size())
+		}
+	}
+}
+
+// ReadHeader returns the first line of the (possibly compressed) file
+func ReadHeader(fpath string, bufSize int, delimiter []byte) (string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	input := bufio.NewReader(f)
+	reader, err := NewDecompressingReader(input, PeekCompression(input))
+	if err != nil {
+		return "", err
+	}
+	return PeekLine(bufio.NewReaderSize(reader, bufSize), delimiter)
+}
@@ -2,9 +2,15 @@ package io
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
 )
 
 func checkValidPath(path string) error {
@@ -31,6 +37,49 @@ func ParseInputPath() (string, error) {
 	return path, nil
 }
 
+// StdinPath is a special path which means reading the input from stdin
+const StdinPath = "-"
+
+// ParseInputPaths validates paths passed as arguments, expanding glob patterns;
+// `-` is kept as is and means reading from stdin
+func ParseInputPaths(args []string) ([]string, error) {
+	paths := make([]string, 0, len(args))
+	stdinUsed := false
+	for _, arg := range args {
+		if arg == StdinPath {
+			if stdinUsed {
+				return nil, fmt.Errorf("error: stdin can be used as input only once")
+			}
+			stdinUsed = true
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			// not a pattern or nothing matched, so report the path itself
+			err = checkValidPath(arg)
+			if err != nil {
+				return nil, err
+			}
+			matches = []string{arg}
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// IsStdinPiped checks whether stdin is redirected from a file or a pipe, rather than a terminal
+func IsStdinPiped() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice == 0
+}
+
 // PrintResult prints slice of strings to stdout
 func PrintResult(res []string) {
 	for _, r := range res {
@@ -38,70 +87,210 @@ func PrintResult(res []string) {
 	}
 }
 
+// PrintRecords prints urls of the records to stdout,
+// optionally followed by their values in the input file format
+func PrintRecords(res []record.Record, withValues bool, values record.ValueFormat) {
+	for _, r := range res {
+		if withValues {
+			fmt.Printf("%s  %s\n", r.Url, values.Format(r))
+			continue
+		}
+		fmt.Println(r.Url)
+	}
+}
+
 // FileSegmentPointer represents starting byte index and length of data segment in bytes
 type FileSegmentPointer struct {
 	Fpath   string
 	BufSize int
 	Start   int64
 	Len     int64
+	// Source is an index of the input among all inputs processed together
+	Source int
+	// Data holds segment's content for inputs which can't be seeked (e.g. stdin)
+	// or a slice of the memory-mapped file; if it's set, segment should be read from it instead of the file
+	Data []byte
+	// BGZF is set for segments of BGZF compressed files, then `Start` and `Len`
+	// point to the compressed blocks
+	BGZF *BGZFRange
+}
+
+// SegmentReader reads content of a single segment
+type SegmentReader struct {
+	io.Reader
+	// Offset is a position of the first read byte in the (uncompressed) input
+	Offset int64
+	closer io.Closer
+}
+
+// Close closes the underlying file, if any
+func (r *SegmentReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+// OpenSegment opens segment for reading: it could be in-memory data,
+// a part of the file, or decompressed lines of the BGZF blocks;
+// returned reader stops at the segment end
+func OpenSegment(segment FileSegmentPointer, delimiter []byte) (*SegmentReader, error) {
+	if segment.Data != nil {
+		return &SegmentReader{Reader: bytes.NewReader(segment.Data), Offset: segment.Start}, nil
+	}
+	if segment.BGZF != nil && len(delimiter) != 1 {
+		return nil, fmt.Errorf("error: BGZF segments can be split only by a single-byte delimiter")
+	}
+	f, err := os.Open(segment.Fpath)
+	if err != nil {
+		return nil, err
+	}
+	if segment.BGZF != nil {
+		r, offset, err := openBGZFSegment(f, segment, delimiter[0])
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &SegmentReader{Reader: r, Offset: offset, closer: f}, nil
+	}
+	_, err = f.Seek(segment.Start, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &SegmentReader{Reader: io.LimitReader(f, segment.Len), Offset: segment.Start, closer: f}, nil
 }
 
-// GetFileSegments reads file and returns channel with segments pointers of ~`segmentSize` based on provided delimiter
-func GetFileSegments(fpath string, bufSize int, segmentSize int64, delimiter byte) (chan FileSegmentPointer, error) {
+// GetFileSegments splits file into segments of ~`segmentSize` bytes by the single rule:
+// each segment starts right after the delimiter (or at the file start) and ends on the delimiter
+// (or at the file end), so segments tile the file exactly; segment is extended till the next
+// delimiter, which is searched reading `bufSize` bytes at once. Segments emission stops
+// and the channel gets closed as soon as the context is cancelled
+func GetFileSegments(ctx context.Context, fpath string, bufSize int, segmentSize int64, delimiter []byte) (*Segments, error) {
 	f, err := os.Open(fpath)
 	if err != nil {
 		return nil, err
 	}
-	var (
-		pointer     int64 = 0
-		seek        int64 = 0
-		start       int64 = 0
-		chunkLength int64 = 0
-		n           int
-		segment     FileSegmentPointer
-	)
 	fi, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 	fsize := fi.Size()
 	if segmentSize <= 0 {
 		segmentSize = fsize
 	}
-	buf := make([]byte, bufSize)
-	segmentsChan := make(chan FileSegmentPointer)
+	if bufSize <= 0 {
+		f.Close()
+		return nil, fmt.Errorf("error: buffer size should be a positive number")
+	}
+	buf := make([]byte, bufSize+len(delimiter)-1)
+	segments := &Segments{C: make(chan FileSegmentPointer)}
 	go func() {
-		for err == nil {
-			segment = FileSegmentPointer{
+		defer f.Close()
+		defer close(segments.C)
+		var start int64 = 0
+		for start < fsize {
+			end := fsize
+			if start+segmentSize < fsize {
+				// segment should end on the first delimiter which ends at or after the target end
+				from := start + segmentSize - int64(len(delimiter))
+				if from < start {
+					from = start
+				}
+				pos, err := indexAt(ctx, f, from, buf, delimiter)
+				if err != nil {
+					segments.err = err
+					return
+				}
+				if pos >= 0 {
+					end = pos + int64(len(delimiter))
+				}
+			}
+			segment := FileSegmentPointer{
 				Fpath:   fpath,
 				BufSize: bufSize,
+				Start:   start,
+				Len:     end - start,
 			}
-			chunkLength += segmentSize
-			seek = pointer + chunkLength
-			if seek >= (fsize - 1) {
-				segment.Start = pointer
-				segment.Len = fsize - pointer - 1
-				segmentsChan <- segment
-			}
-			f.Seek(seek, 0)
-			n, err = f.Read(buf)
-			if n > 0 {
-				for _, b := range buf[:n] {
-					if b == delimiter && (seek+chunkLength) < (fsize-1) {
-						start = pointer
-						segment.Start = start
-						segment.Len = chunkLength
-						pointer += chunkLength + 1
-						chunkLength = 0
-						segmentsChan <- segment
-						break
-					}
-					chunkLength++
-				}
+			select {
+			case segments.C <- segment:
+			case <-ctx.Done():
+				return
 			}
+			start = end
 		}
-		close(segmentsChan)
-		f.Close()
 	}()
-	return segmentsChan, nil
+	return segments, nil
+}
+
+// indexAt returns position of the first delimiter at or after the offset, or -1 if there is none;
+// consecutive reads overlap by `len(delimiter)-1` bytes, so the buffer should be longer than that;
+// search stops once the context is cancelled
+func indexAt(ctx context.Context, f io.ReaderAt, offset int64, buf []byte, delimiter []byte) (int64, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		n, err := f.ReadAt(buf, offset)
+		if i := bytes.Index(buf[:n], delimiter); i >= 0 {
+			return offset + int64(i), nil
+		}
+		if err == io.EOF {
+			return -1, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error: cannot read file at %v: %w", offset, err)
+		}
+		if n < len(delimiter) {
+			// the search can't move forward
+			return 0, fmt.Errorf("error: cannot read file at %v: buffer is shorter than the delimiter", offset)
+		}
+		offset += int64(n - len(delimiter) + 1)
+	}
+}
+
+// ValidateSegments checks that segments tile the file exactly: they go one by one without gaps
+// and overlaps, the first one starts at the file start, the last one ends at the file end,
+// and all of them, except the last one, end on the delimiter
+func ValidateSegments(fpath string, segments []FileSegmentPointer, delimiter []byte) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var next int64 = 0
+	last := make([]byte, len(delimiter))
+	for i, segment := range segments {
+		if segment.Start != next {
+			return fmt.Errorf("error: segment %v starts at %v, but previous one ends at %v", i, segment.Start, next)
+		}
+		if segment.Len <= 0 {
+			return fmt.Errorf("error: segment %v at %v is empty", i, segment.Start)
+		}
+		next = segment.Start + segment.Len
+		if next > fi.Size() {
+			return fmt.Errorf("error: segment %v ends at %v after the file end %v", i, next, fi.Size())
+		}
+		if next == fi.Size() {
+			continue
+		}
+		if next-segment.Start < int64(len(delimiter)) {
+			return fmt.Errorf("error: segment %v ends at %v not on the delimiter", i, next)
+		}
+		if _, err := f.ReadAt(last, next-int64(len(delimiter))); err != nil {
+			return err
+		}
+		if !bytes.Equal(last, delimiter) {
+			return fmt.Errorf("error: segment %v ends at %v not on the delimiter", i, next)
+		}
+	}
+	if next != fi.Size() {
+		return fmt.Errorf("error: segments end at %v, but file size is %v", next, fi.Size())
+	}
+	return nil
 }
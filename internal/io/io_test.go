@@ -1,8 +1,14 @@
 package io
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+	"testing/quick"
 )
 
 func TestCheckValidPath(t *testing.T) {
@@ -38,21 +44,176 @@ http://api.tech.com/item/124345  231
 		t.Fatal(err)
 	}
 
-	segmentsSizes := []int64{72, 73}
-	segmentsChan, err := GetFileSegments(fpath, 64, 64, '\n')
+	segmentsSizes := []int64{73, 73, 1}
+	fileSegments, err := GetFileSegments(context.Background(), fpath, 64, 64, DefaultDelimiter)
 	if err != nil {
 		t.Fatal(err)
 	}
 	segments := make([]FileSegmentPointer, 0)
-	for segment := range segmentsChan {
+	for segment := range fileSegments.C {
 		segments = append(segments, segment)
 	}
-	if len(segments) > 2 {
-		t.Fatalf("Segments array size should be = 2, but got %v", len(segments))
+	if err := fileSegments.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != len(segmentsSizes) {
+		t.Fatalf("Segments array size should be = %v, but got %v", len(segmentsSizes), len(segments))
 	}
 	for i := range segments {
 		if segments[i].Len != segmentsSizes[i] {
 			t.Fatalf("Segment length should be = %v, but got %v", segmentsSizes[i], segments[i].Len)
 		}
 	}
+	if err := ValidateSegments(fpath, segments, DefaultDelimiter); err != nil {
+		t.Fatal(err)
+	}
+	segments[1].Len--
+	if err := ValidateSegments(fpath, segments, DefaultDelimiter); err == nil {
+		t.Fatal("Segment which does not end on the delimiter should be reported")
+	}
+	if err := ValidateSegments(fpath, segments[:1], DefaultDelimiter); err == nil {
+		t.Fatal("Segments which do not cover the whole file should be reported")
+	}
+}
+
+// randomLines generates lines of random length, including empty and long ones,
+// the last line may have no delimiter
+func randomLines(rnd *rand.Rand, nLines int, delimiter []byte) []byte {
+	var data bytes.Buffer
+	for i := 0; i < nLines; i++ {
+		n := rnd.Intn(40)
+		if rnd.Intn(10) == 0 {
+			n = rnd.Intn(500)
+		}
+		for j := 0; j < n; j++ {
+			data.WriteByte(byte('a' + rnd.Intn(26)))
+		}
+		if i < nLines-1 || rnd.Intn(2) == 0 {
+			data.Write(delimiter)
+		}
+	}
+	return data.Bytes()
+}
+
+func TestGetFileSegmentsTiling(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	delimiters := [][]byte{DefaultDelimiter, []byte("\r\n"), {0}, []byte("<eol>")}
+	property := func(seed int64, nLines uint8, segmentSize uint16, bufSize uint8) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		delimiter := delimiters[rnd.Intn(len(delimiters))]
+		data := randomLines(rnd, int(nLines), delimiter)
+		if err := os.WriteFile(fpath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fileSegments, err := GetFileSegments(context.Background(), fpath, int(bufSize)+1, int64(segmentSize%1024), delimiter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments := make([]FileSegmentPointer, 0)
+		var content bytes.Buffer
+		for segment := range fileSegments.C {
+			segments = append(segments, segment)
+			r, err := OpenSegment(segment, delimiter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content.ReadFrom(r)
+			r.Close()
+		}
+		if err := fileSegments.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ValidateSegments(fpath, segments, delimiter); err != nil {
+			t.Logf("delimiter %q: %v", delimiter, err)
+			return false
+		}
+		return bytes.Equal(content.Bytes(), data)
+	}
+	err := quick.Check(property, &quick.Config{MaxCount: 300, Rand: rand.New(rand.NewSource(42))})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetFileSegmentsCanceled(t *testing.T) {
+	fpath := "/tmp/clickhouse-file-reader-test-io-canceled"
+	defer os.RemoveAll(fpath)
+	data := []byte(`
+http://api.tech.com/item/121345  9
+http://api.tech.com/item/122345  350
+http://api.tech.com/item/123345  25
+http://api.tech.com/item/124345  231
+
+`)
+	err := os.WriteFile(fpath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	segments, err := GetFileSegments(ctx, fpath, 64, 64, DefaultDelimiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-segments.C
+	cancel()
+	// channel must be closed after cancellation, otherwise the test hangs
+	for range segments.C {
+	}
+}
+
+func TestGetFileSegmentsBufSize(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(fpath, []byte("http://api.tech.com/item/121345  9\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, bufSize := range []int{0, -5} {
+		if _, err := GetFileSegments(context.Background(), fpath, bufSize, 4, DefaultDelimiter); err == nil {
+			t.Fatalf("Expected error for buffer size %v", bufSize)
+		}
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// empty buffer can't move the search forward
+	if _, err := indexAt(context.Background(), f, 0, nil, DefaultDelimiter); err == nil {
+		t.Fatal("Expected error for the empty buffer")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := indexAt(ctx, f, 0, make([]byte, 4), DefaultDelimiter); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected `%v` but got `%v`", context.Canceled, err)
+	}
+}
+
+func TestParseInputPaths(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.log", "b.log", "c.txt"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, err := ParseInputPaths([]string{filepath.Join(dir, "*.log"), StdinPath, filepath.Join(dir, "c.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := []string{filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log"), StdinPath, filepath.Join(dir, "c.txt")}
+	if len(paths) != len(gt) {
+		t.Fatalf("Expected %v paths, but got %v", gt, paths)
+	}
+	for i := range gt {
+		if paths[i] != gt[i] {
+			t.Fatalf("Expected %v paths, but got %v", gt, paths)
+		}
+	}
+	_, err = ParseInputPaths([]string{filepath.Join(dir, "d.txt")})
+	if err == nil {
+		t.Fatal("Missing file should be reported")
+	}
+	_, err = ParseInputPaths([]string{StdinPath, StdinPath})
+	if err == nil {
+		t.Fatal("Stdin can't be read twice")
+	}
 }
@@ -0,0 +1,193 @@
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrLineTooLong is returned for lines longer than the max line length,
+// reader skips such line and can be used further
+var ErrLineTooLong = errors.New("line is too long")
+
+// DefaultDelimiter separates lines when no other delimiter is set;
+// trailing '\r' of such lines is dropped by the callers, so CRLF files are read the same way
+var DefaultDelimiter = []byte{'\n'}
+
+// ValidateDelimiter checks that the delimiter can be used to split lines: it should be non-empty and
+// shouldn't overlap with itself (like `aa`), so each found occurrence of it is a line boundary
+// independently of the position where the search started
+func ValidateDelimiter(delimiter []byte) error {
+	if len(delimiter) == 0 {
+		return fmt.Errorf("error: delimiter should not be empty")
+	}
+	for i := 1; i < len(delimiter); i++ {
+		if bytes.Equal(delimiter[:i], delimiter[len(delimiter)-i:]) {
+			return fmt.Errorf("error: delimiter %q overlaps with itself", delimiter)
+		}
+	}
+	return nil
+}
+
+// ParseDelimiter parses delimiter passed as a string with Go escape sequences, like `\r\n` or `\x00`
+func ParseDelimiter(str string) ([]byte, error) {
+	unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(str, `"`, `\"`) + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("error: cannot parse delimiter `%v`: %w", str, err)
+	}
+	delimiter := []byte(unquoted)
+	if err := ValidateDelimiter(delimiter); err != nil {
+		return nil, err
+	}
+	return delimiter, nil
+}
+
+// LineReader reads delimited lines of any length: lines which don't fit into the
+// reader's buffer are collected in the growing buffer, lines longer than `maxLen`
+// are streamed through without keeping them in memory
+type LineReader struct {
+	r         *bufio.Reader
+	delimiter []byte
+	maxLen    int
+	long      []byte
+	tail      []byte
+}
+
+// NewLineReader creates reader with the initial buffer of `bufSize` bytes;
+// zero `maxLen` means that lines length is not limited
+func NewLineReader(r io.Reader, bufSize int, maxLen int, delimiter []byte) *LineReader {
+	return &LineReader{
+		r:         bufio.NewReaderSize(r, bufSize),
+		delimiter: delimiter,
+		maxLen:    maxLen,
+	}
+}
+
+// Reset makes the reader read lines from `r` with the new limit and delimiter,
+// so the reader along with its buffers can be reused
+func (lr *LineReader) Reset(r io.Reader, maxLen int, delimiter []byte) {
+	lr.r.Reset(r)
+	lr.delimiter = delimiter
+	lr.maxLen = maxLen
+	lr.long = lr.long[:0]
+	lr.tail = lr.tail[:0]
+}
+
+// Size returns size of the reader's buffer
+func (lr *LineReader) Size() int {
+	return lr.r.Size()
+}
+
+// ReadLine returns the next line without the delimiter and amount of bytes consumed
+// from the input, including the delimiter; returned line is valid only till the next call.
+// Lines longer than `maxLen` are returned truncated to `maxLen` along with ErrLineTooLong.
+// The last line may have no delimiter, io.EOF is returned only when there are no more lines
+func (lr *LineReader) ReadLine() ([]byte, int, error) {
+	last := lr.delimiter[len(lr.delimiter)-1]
+	chunk, err := lr.r.ReadSlice(last)
+	if err == nil && bytes.HasSuffix(chunk, lr.delimiter) {
+		return lr.limit(chunk[:len(chunk)-len(lr.delimiter)], len(chunk))
+	}
+	if err != nil && err != bufio.ErrBufferFull {
+		if err == io.EOF && len(chunk) > 0 {
+			return lr.limit(chunk, len(chunk))
+		}
+		return chunk, len(chunk), err
+	}
+	// line is longer than the buffer or contains the last byte of the multi-byte delimiter,
+	// `tail` keeps the last bytes of the line to find the delimiter even if the line is truncated
+	lr.long = lr.long[:0]
+	lr.tail = lr.tail[:0]
+	n := 0
+	tooLong := false
+	for {
+		n += len(chunk)
+		if !tooLong {
+			lr.long = append(lr.long, chunk...)
+			if lr.maxLen > 0 && len(lr.long) > lr.maxLen+len(lr.delimiter) {
+				lr.long = lr.long[:lr.maxLen]
+				tooLong = true
+			}
+		}
+		lr.tail = appendTail(lr.tail, chunk, len(lr.delimiter))
+		if err == nil && bytes.Equal(lr.tail, lr.delimiter) {
+			if !tooLong {
+				lr.long = lr.long[:len(lr.long)-len(lr.delimiter)]
+			}
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, n, err
+		}
+		chunk, err = lr.r.ReadSlice(last)
+	}
+	if tooLong {
+		return lr.long, n, ErrLineTooLong
+	}
+	return lr.limit(lr.long, n)
+}
+
+// TrimCR drops the trailing '\r' of the line split by the `\n` delimiter, so CRLF lines
+// are read the same way as LF ones; lines split by other delimiters are kept as is
+func TrimCR(line, delimiter []byte) []byte {
+	if len(delimiter) == 1 && delimiter[0] == '\n' && len(line) > 0 && line[len(line)-1] == '\r' {
+		return line[:len(line)-1]
+	}
+	return line
+}
+
+func (lr *LineReader) limit(line []byte, n int) ([]byte, int, error) {
+	if lr.maxLen > 0 && len(line) > lr.maxLen {
+		return line[:lr.maxLen], n, ErrLineTooLong
+	}
+	return line, n, nil
+}
+
+// appendTail appends data to the tail keeping only its last `n` bytes
+func appendTail(tail, data []byte, n int) []byte {
+	if len(data) > n {
+		data = data[len(data)-n:]
+	}
+	tail = append(tail, data...)
+	if len(tail) > n {
+		tail = append(tail[:0], tail[len(tail)-n:]...)
+	}
+	return tail
+}
+
+// SliceLineReader reads delimited lines of the in-memory data, returned lines are slices
+// of the data, so nothing is copied; it behaves the same way as LineReader
+type SliceLineReader struct {
+	data      []byte
+	delimiter []byte
+	maxLen    int
+}
+
+// NewSliceLineReader creates reader of the data lines, zero `maxLen` means that lines length is not limited
+func NewSliceLineReader(data []byte, maxLen int, delimiter []byte) *SliceLineReader {
+	return &SliceLineReader{data: data, delimiter: delimiter, maxLen: maxLen}
+}
+
+// ReadLine returns the next line without the delimiter and amount of bytes consumed, including the delimiter;
+// lines longer than `maxLen` are returned truncated along with ErrLineTooLong
+func (lr *SliceLineReader) ReadLine() ([]byte, int, error) {
+	if len(lr.data) == 0 {
+		return nil, 0, io.EOF
+	}
+	line, n := lr.data, len(lr.data)
+	if i := bytes.Index(lr.data, lr.delimiter); i >= 0 {
+		line, n = lr.data[:i], i+len(lr.delimiter)
+	}
+	lr.data = lr.data[n:]
+	if lr.maxLen > 0 && len(line) > lr.maxLen {
+		return line[:lr.maxLen], n, ErrLineTooLong
+	}
+	return line, n, nil
+}
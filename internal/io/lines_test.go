@@ -0,0 +1,128 @@
+package io
+
+import (
+	"strings"
+	"testing"
+)
+
+type lineReader interface {
+	ReadLine() ([]byte, int, error)
+}
+
+// newLineReaders returns both buffered and in-memory readers of the same data, they should behave the same way
+func newLineReaders(data string, maxLen int, delimiter []byte) map[string]lineReader {
+	// reused reader is left in the middle of the long line of another input
+	reused := NewLineReader(strings.NewReader(strings.Repeat("x", 100)+"\x00y"), 16, 10, []byte("\x00"))
+	reused.ReadLine()
+	reused.Reset(strings.NewReader(data), maxLen, delimiter)
+	return map[string]lineReader{
+		"buffered": NewLineReader(strings.NewReader(data), 16, maxLen, delimiter),
+		"reused":   reused,
+		"slice":    NewSliceLineReader([]byte(data), maxLen, delimiter),
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	data := "short\n" + long + "\n\n" + long + "b\nlast"
+	type line struct {
+		text    string
+		n       int
+		tooLong bool
+	}
+	cases := []struct {
+		maxLen int
+		gt     []line
+	}{
+		{0, []line{{"short", 6, false}, {long, 101, false}, {"", 1, false}, {long + "b", 102, false}, {"last", 4, false}}},
+		{100, []line{{"short", 6, false}, {long, 101, false}, {"", 1, false}, {long, 102, true}, {"last", 4, false}}},
+		{3, []line{{"sho", 6, true}, {"aaa", 101, true}, {"", 1, false}, {"aaa", 102, true}, {"las", 4, true}}},
+	}
+	for _, c := range cases {
+		for name, lr := range newLineReaders(data, c.maxLen, DefaultDelimiter) {
+			for _, gt := range c.gt {
+				text, n, err := lr.ReadLine()
+				if (err == ErrLineTooLong) != gt.tooLong || (err != nil && err != ErrLineTooLong) {
+					t.Fatalf("%v, max %v: unexpected error `%v` for line `%v`", name, c.maxLen, err, gt.text)
+				}
+				if string(text) != gt.text || n != gt.n {
+					t.Fatalf("%v, max %v: expected `%v` of %v bytes but got `%v` of %v bytes", name, c.maxLen, gt.text, gt.n, string(text), n)
+				}
+			}
+			if _, _, err := lr.ReadLine(); err == nil {
+				t.Fatalf("%v, max %v: expected EOF", name, c.maxLen)
+			}
+		}
+	}
+}
+
+func TestLineReaderDelimiters(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	cases := []struct {
+		delimiter string
+		data      string
+		gt        []string
+	}{
+		{"\n", "a\r\nb\n\nc", []string{"a\r", "b", "", "c"}},
+		{"\r\n", "a\rb\nc\r\n\r\n" + long + "\r" + long + "\r\nd\r", []string{"a\rb\nc", "", long + "\r" + long, "d\r"}},
+		{"\x00", "a\nb\x00\x00c\x00", []string{"a\nb", "", "c"}},
+		{"<eol>", "a<eo<eol>" + long + "<eol><eol>", []string{"a<eo", long, ""}},
+	}
+	for _, c := range cases {
+		for name, lr := range newLineReaders(c.data, 0, []byte(c.delimiter)) {
+			n := 0
+			for _, gt := range c.gt {
+				text, consumed, err := lr.ReadLine()
+				if err != nil {
+					t.Fatalf("%v, delimiter %q: unexpected error `%v` for line %q", name, c.delimiter, err, gt)
+				}
+				if string(text) != gt {
+					t.Fatalf("%v, delimiter %q: expected %q but got %q", name, c.delimiter, gt, text)
+				}
+				n += consumed
+			}
+			if _, _, err := lr.ReadLine(); err == nil {
+				t.Fatalf("%v, delimiter %q: expected EOF", name, c.delimiter)
+			}
+			if n != len(c.data) {
+				t.Fatalf("%v, delimiter %q: expected %v bytes consumed but got %v", name, c.delimiter, len(c.data), n)
+			}
+		}
+	}
+	for name, lr := range newLineReaders(long+"\r\nb", 5, []byte("\r\n")) {
+		if text, n, err := lr.ReadLine(); err != ErrLineTooLong || string(text) != long[:5] || n != len(long)+2 {
+			t.Fatalf("%v: expected truncated line of %v bytes but got %q of %v bytes, error `%v`", name, len(long)+2, text, n, err)
+		}
+		if text, _, err := lr.ReadLine(); err != nil || string(text) != "b" {
+			t.Fatalf("%v: expected the last line `b` but got %q, error `%v`", name, text, err)
+		}
+	}
+}
+
+func TestValidateDelimiter(t *testing.T) {
+	for _, delimiter := range []string{"\n", "\r\n", "\x00", "<eol>", "ab"} {
+		if err := ValidateDelimiter([]byte(delimiter)); err != nil {
+			t.Fatalf("Expected delimiter %q to be valid but got `%v`", delimiter, err)
+		}
+	}
+	for _, delimiter := range []string{"", "aa", "aba", "abab"} {
+		if err := ValidateDelimiter([]byte(delimiter)); err == nil {
+			t.Fatalf("Expected delimiter %q to be invalid", delimiter)
+		}
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	cases := map[string]string{`\n`: "\n", `\r\n`: "\r\n", `\x00`: "\x00", `\t`: "\t", `;`: ";", `"`: `"`}
+	for str, gt := range cases {
+		delimiter, err := ParseDelimiter(str)
+		if err != nil || string(delimiter) != gt {
+			t.Fatalf("Expected %q for `%v` but got %q, error `%v`", gt, str, delimiter, err)
+		}
+	}
+	for _, str := range []string{``, `\q`, `aa`} {
+		if _, err := ParseDelimiter(str); err == nil {
+			t.Fatalf("Expected error for `%v`", str)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package io
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+)
+
+// ErrMmapUnsupported is returned when memory-mapped reading isn't available on the platform
+var ErrMmapUnsupported = errors.New("error: memory-mapped reading is not supported on this platform")
+
+// MappedFile is a file mapped into memory once, so segments are handed to workers
+// as slices of the mapping without reading and copying them;
+// file shouldn't be truncated while it's mapped
+type MappedFile struct {
+	Path string
+	data []byte
+}
+
+// OpenMapped maps the whole file into memory for reading
+func OpenMapped(fpath string) (*MappedFile, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	// mapping is kept after the file is closed
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &MappedFile{Path: fpath}
+	if fi.Size() == 0 {
+		// empty mappings are not allowed
+		return m, nil
+	}
+	if int64(int(fi.Size())) != fi.Size() {
+		return nil, errors.New("error: file is too large to be mapped")
+	}
+	m.data, err = mmap(f, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Bytes returns content of the file, it's valid only till the file is closed
+func (m *MappedFile) Bytes() []byte {
+	return m.data
+}
+
+// Close unmaps the file, slices of it can't be used after that
+func (m *MappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmap(data)
+}
+
+// GetMappedSegments splits the mapped file into segments by the same rule as GetFileSegments,
+// but segments hold slices of the mapping, so workers read them without syscalls and copies
+func GetMappedSegments(ctx context.Context, m *MappedFile, bufSize int, segmentSize int64, delimiter []byte) *Segments {
+	data := m.Bytes()
+	fsize := int64(len(data))
+	if segmentSize <= 0 {
+		segmentSize = fsize
+	}
+	segments := &Segments{C: make(chan FileSegmentPointer)}
+	go func() {
+		defer close(segments.C)
+		var start int64 = 0
+		for start < fsize {
+			end := fsize
+			if start+segmentSize < fsize {
+				from := start + segmentSize - int64(len(delimiter))
+				if from < start {
+					from = start
+				}
+				if i := bytes.Index(data[from:], delimiter); i >= 0 {
+					end = from + int64(i+len(delimiter))
+				}
+			}
+			segment := FileSegmentPointer{
+				Fpath:   m.Path,
+				BufSize: bufSize,
+				Start:   start,
+				Len:     end - start,
+				Data:    data[start:end:end],
+			}
+			select {
+			case segments.C <- segment:
+			case <-ctx.Done():
+				return
+			}
+			start = end
+		}
+	}()
+	return segments
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+package io
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetMappedSegments(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	rnd := rand.New(rand.NewSource(42))
+	for _, delimiter := range [][]byte{DefaultDelimiter, []byte("\r\n")} {
+		for _, segmentSize := range []int64{0, 1, 64, 1000} {
+			data := randomLines(rnd, 100, delimiter)
+			if err := os.WriteFile(fpath, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			fileSegments, err := GetFileSegments(context.Background(), fpath, 64, segmentSize, delimiter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mapped, err := OpenMapped(fpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mappedSegments := GetMappedSegments(context.Background(), mapped, 64, segmentSize, delimiter)
+			for segment := range fileSegments.C {
+				mappedSegment, ok := <-mappedSegments.C
+				if !ok {
+					t.Fatalf("Expected mapped segment at %v", segment.Start)
+				}
+				if mappedSegment.Start != segment.Start || mappedSegment.Len != segment.Len {
+					t.Fatalf("Expected segment %v+%v, but got %v+%v", segment.Start, segment.Len, mappedSegment.Start, mappedSegment.Len)
+				}
+				if !bytes.Equal(mappedSegment.Data, data[segment.Start:segment.Start+segment.Len]) {
+					t.Fatalf("Segment %v+%v has wrong content", segment.Start, segment.Len)
+				}
+			}
+			if _, ok := <-mappedSegments.C; ok {
+				t.Fatal("Mapped segments should end with the file segments")
+			}
+			if err := mapped.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := os.WriteFile(fpath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := OpenMapped(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+	if _, ok := <-GetMappedSegments(context.Background(), mapped, 64, 64, DefaultDelimiter).C; ok {
+		t.Fatal("Empty file should have no segments")
+	}
+}
@@ -0,0 +1,134 @@
+package io
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// DefaultStreamSegmentSize is used to split streams when segment size is not set,
+// since the whole stream can't be kept in memory as a single segment
+const DefaultStreamSegmentSize int64 = 1024 * 1024
+
+// Segments holds channel of segments emitted by the segmenter
+type Segments struct {
+	C   chan FileSegmentPointer
+	err error
+}
+
+// Err returns the error which stopped the segmenter before reaching the end of input;
+// it should be checked only after the segments channel is closed
+func (s *Segments) Err() error {
+	return s.err
+}
+
+// GetStreamSegments reads the stream which can't be seeked (e.g. stdin) and emits
+// in-memory segments of ~`segmentSize` which always end with the delimiter (except the last one);
+// `name` is only used to fill the path of emitted segments.
+// Lines longer than `maxLineLen` (if it's set) are not kept in memory as a whole: only their first
+// `maxLineLen`+1 bytes are emitted as a separate segment, so they're reported as too long by line readers,
+// while the segment's length still covers the whole line
+func GetStreamSegments(ctx context.Context, r io.Reader, name string, bufSize int, segmentSize int64, maxLineLen int, delimiter []byte) *Segments {
+	if segmentSize <= 0 {
+		segmentSize = DefaultStreamSegmentSize
+	}
+	segments := &Segments{C: make(chan FileSegmentPointer)}
+	emit := func(segment FileSegmentPointer) bool {
+		select {
+		case segments.C <- segment:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	go func() {
+		defer close(segments.C)
+		var (
+			start int64 = 0
+			carry []byte
+			// oversized holds the head of the too long line while the rest of it is dropped,
+			// skipped counts the dropped bytes
+			oversized []byte
+			skipped   int64
+		)
+		for {
+			buf := make([]byte, int64(len(carry))+segmentSize)
+			copy(buf, carry)
+			n, err := io.ReadFull(r, buf[len(carry):])
+			buf = buf[:len(carry)+n]
+			eof := err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !eof {
+				segments.err = err
+				return
+			}
+			if oversized != nil {
+				end := bytes.Index(buf, delimiter)
+				if end < 0 && !eof {
+					// the last bytes are kept, since the delimiter may be split between reads
+					carry = keepTail(buf, len(delimiter)-1)
+					skipped += int64(len(buf) - len(carry))
+					continue
+				}
+				if end < 0 {
+					end = len(buf)
+				} else {
+					end += len(delimiter)
+					oversized = append(oversized, delimiter...)
+				}
+				segment := FileSegmentPointer{
+					Fpath:   name,
+					BufSize: bufSize,
+					Start:   start,
+					Len:     int64(maxLineLen+1) + skipped + int64(end),
+					Data:    oversized,
+				}
+				if !emit(segment) {
+					return
+				}
+				start += segment.Len
+				buf, oversized = buf[end:], nil
+			}
+			cut := len(buf)
+			if !eof {
+				// segment should end on the delimiter, the rest goes to the next one
+				cut = bytes.LastIndex(buf, delimiter) + len(delimiter)
+				if cut < len(delimiter) {
+					// no delimiter in the whole segment, so just keep reading
+					carry = buf
+					if maxLineLen > 0 && len(buf) > maxLineLen {
+						oversized = append([]byte{}, buf[:maxLineLen+1]...)
+						carry = keepTail(buf, len(delimiter)-1)
+						skipped = int64(len(buf)-len(carry)) - int64(maxLineLen+1)
+					}
+					continue
+				}
+			}
+			carry = buf[cut:]
+			if cut > 0 {
+				segment := FileSegmentPointer{
+					Fpath:   name,
+					BufSize: bufSize,
+					Start:   start,
+					Len:     int64(cut),
+					Data:    buf[:cut:cut],
+				}
+				if !emit(segment) {
+					return
+				}
+				start += int64(cut)
+			}
+			if eof {
+				return
+			}
+		}
+	}()
+	return segments
+}
+
+// keepTail returns copy of the last `n` bytes of the data
+func keepTail(data []byte, n int) []byte {
+	if n > len(data) {
+		n = len(data)
+	}
+	return append([]byte{}, data[len(data)-n:]...)
+}
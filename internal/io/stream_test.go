@@ -0,0 +1,104 @@
+package io
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestGetStreamSegments(t *testing.T) {
+	data := []byte(`http://api.tech.com/item/121345  9
+http://api.tech.com/item/122345  350
+http://api.tech.com/item/123345  25
+http://api.tech.com/item/124345  231
+http://api.tech.com/item/125345  111`)
+	for _, segmentSize := range []int64{0, 1, 10, 36, 64, 1024} {
+		segments := GetStreamSegments(context.Background(), bytes.NewReader(data), StdinPath, 64, segmentSize, 0, DefaultDelimiter)
+		joined := make([]byte, 0, len(data))
+		var start int64 = 0
+		for segment := range segments.C {
+			if segment.Start != start {
+				t.Fatalf("Segment should start at %v, but got %v", start, segment.Start)
+			}
+			if segment.Len != int64(len(segment.Data)) {
+				t.Fatalf("Segment length should be = %v, but got %v", len(segment.Data), segment.Len)
+			}
+			end := segment.Start + segment.Len
+			if end < int64(len(data)) && segment.Data[len(segment.Data)-1] != '\n' {
+				t.Fatalf("Segment `%s` should end with the delimiter", segment.Data)
+			}
+			joined = append(joined, segment.Data...)
+			start = end
+		}
+		if segments.Err() != nil {
+			t.Fatal(segments.Err())
+		}
+		if !bytes.Equal(joined, data) {
+			t.Fatalf("Segments of size %v do not cover the whole stream: `%s`", segmentSize, joined)
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestGetStreamSegmentsError(t *testing.T) {
+	segments := GetStreamSegments(context.Background(), failingReader{}, StdinPath, 64, 64, 0, DefaultDelimiter)
+	for range segments.C {
+	}
+	if segments.Err() == nil {
+		t.Fatal("Read error should be reported")
+	}
+}
+
+func TestGetStreamSegmentsMaxLineLen(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 1000)
+	inputs := map[string][]byte{
+		"no delimiter": long,
+		"lines":        append(append([]byte("http://api.tech.com/item/1  1\r\n"), long...), "\r\nhttp://api.tech.com/item/2  2"...),
+	}
+	maxLineLen := 40
+	for name, data := range inputs {
+		for _, delimiter := range [][]byte{DefaultDelimiter, []byte("\r\n")} {
+			for _, segmentSize := range []int64{1, 7, 64} {
+				segments := GetStreamSegments(context.Background(), bytes.NewReader(data), StdinPath, 64, segmentSize, maxLineLen, delimiter)
+				var (
+					start    int64
+					oversize int
+				)
+				for segment := range segments.C {
+					if segment.Start != start {
+						t.Fatalf("%v: segment should start at %v, but got %v", name, start, segment.Start)
+					}
+					if len(segment.Data) > maxLineLen+int(segmentSize)+len(delimiter) {
+						t.Fatalf("%v: segment of %v bytes is longer than the line limit", name, len(segment.Data))
+					}
+					lines := NewSliceLineReader(segment.Data, maxLineLen, delimiter)
+					for {
+						line, _, err := lines.ReadLine()
+						if err == io.EOF {
+							break
+						}
+						if err == ErrLineTooLong {
+							oversize++
+						} else if !bytes.Contains(data, line) {
+							t.Fatalf("%v: unexpected line `%s`", name, line)
+						}
+					}
+					start += segment.Len
+				}
+				if segments.Err() != nil {
+					t.Fatal(segments.Err())
+				}
+				if start != int64(len(data)) || oversize != 1 {
+					t.Fatalf("%v: expected %v bytes with 1 oversized line, but got %v bytes and %v lines", name, len(data), start, oversize)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package ranker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	stdio "io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+	"github.com/gasparian/clickhouse-test-file-reader/pkg/heap"
+)
+
+// Aggregate defines how values of the same url are combined before ranking
+type Aggregate int
+
+const (
+	// AggregateNone ranks every line as a separate record
+	AggregateNone Aggregate = iota
+	AggregateSum
+	AggregateCount
+	AggregateMax
+	AggregateMin
+	// AggregateMean of integers and decimals is ranked by its unrounded value, while the value
+	// itself is rounded half away from zero to the precision of the value type
+	AggregateMean
+)
+
+var aggregateNames = map[Aggregate]string{
+	AggregateNone:  "none",
+	AggregateSum:   "sum",
+	AggregateCount: "count",
+	AggregateMax:   "max",
+	AggregateMin:   "min",
+	AggregateMean:  "mean",
+}
+
+func (a Aggregate) String() string {
+	if name, ok := aggregateNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("Aggregate(%d)", int(a))
+}
+
+// ParseAggregate returns aggregate by its name, `avg` is accepted as an alias of `mean`
+func ParseAggregate(name string) (Aggregate, error) {
+	name = strings.ToLower(name)
+	if name == "avg" {
+		return AggregateMean, nil
+	}
+	for a, n := range aggregateNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return AggregateNone, fmt.Errorf("error: unknown aggregate `%v`", name)
+}
+
+// ErrOverflow is returned when the aggregated integer or decimal value doesn't fit into int64:
+// sum of the values, or count scaled by 10^scale for decimals
+var ErrOverflow = errors.New("error: aggregated value overflows int64")
+
+// group holds partial aggregation state of a single url;
+// integer fields are used for integers and decimals, float ones - for floats
+type group struct {
+	sum   int64
+	count int64
+	max   int64
+	min   int64
+	fsum  float64
+	fmax  float64
+	fmin  float64
+	// positions of the first and the last seen occurrences of the url
+	source     int
+	offset     int64
+	lastSource int
+	lastOffset int64
+}
+
+func newGroup(rec record.Record) group {
+	return group{
+		sum:        rec.Value,
+		count:      1,
+		max:        rec.Value,
+		min:        rec.Value,
+		fsum:       rec.Float,
+		fmax:       rec.Float,
+		fmin:       rec.Float,
+		source:     rec.Source,
+		offset:     rec.Offset,
+		lastSource: rec.Source,
+		lastOffset: rec.Offset,
+	}
+}
+
+// merge combines the other partial state of the same url, ErrOverflow is returned if the sum overflows
+func (g *group) merge(other group, values record.ValueFormat) error {
+	g.count += other.count
+	if values.Type == record.ValueFloat {
+		g.fsum += other.fsum
+		if values.Compare(record.Record{Float: other.fmax}, record.Record{Float: g.fmax}) > 0 {
+			g.fmax = other.fmax
+		}
+		if values.Compare(record.Record{Float: other.fmin}, record.Record{Float: g.fmin}) < 0 {
+			g.fmin = other.fmin
+		}
+	} else {
+		if (other.sum > 0 && g.sum > math.MaxInt64-other.sum) || (other.sum < 0 && g.sum < math.MinInt64-other.sum) {
+			return ErrOverflow
+		}
+		g.sum += other.sum
+		if other.max > g.max {
+			g.max = other.max
+		}
+		if other.min < g.min {
+			g.min = other.min
+		}
+	}
+	if other.source < g.source || (other.source == g.source && other.offset < g.offset) {
+		g.source, g.offset = other.source, other.offset
+	}
+	if other.lastSource > g.lastSource || (other.lastSource == g.lastSource && other.lastOffset > g.lastOffset) {
+		g.lastSource, g.lastOffset = other.lastSource, other.lastOffset
+	}
+	return nil
+}
+
+// value returns record holding the aggregated value in the field of the value type,
+// ErrOverflow is returned if the decimal count doesn't fit into int64 after scaling
+func (g group) value(agg Aggregate, values record.ValueFormat) (record.Record, error) {
+	if agg == AggregateCount {
+		count := g.count
+		switch values.Type {
+		case record.ValueFloat:
+			return record.Record{Float: float64(count)}, nil
+		case record.ValueDecimal:
+			for i := 0; i < values.Scale; i++ {
+				if count > math.MaxInt64/10 {
+					return record.Record{}, ErrOverflow
+				}
+				count *= 10
+			}
+		}
+		return record.Record{Value: count}, nil
+	}
+	if values.Type == record.ValueFloat {
+		switch agg {
+		case AggregateMax:
+			return record.Record{Float: g.fmax}, nil
+		case AggregateMin:
+			return record.Record{Float: g.fmin}, nil
+		case AggregateMean:
+			return record.Record{Float: g.fsum / float64(g.count)}, nil
+		}
+		return record.Record{Float: g.fsum}, nil
+	}
+	switch agg {
+	case AggregateMax:
+		return record.Record{Value: g.max}, nil
+	case AggregateMin:
+		return record.Record{Value: g.min}, nil
+	case AggregateMean:
+		return record.Record{Value: roundedMean(g.sum, g.count), Float: float64(g.sum) / float64(g.count)}, nil
+	}
+	return record.Record{Value: g.sum}, nil
+}
+
+// roundedMean divides the sum by the count rounding half away from zero
+func roundedMean(sum, count int64) int64 {
+	mean, rem := sum/count, sum%count
+	if rem < 0 {
+		rem = -rem
+	}
+	// the same as 2*rem >= count, but without overflow
+	if rem >= count-rem {
+		if sum < 0 {
+			return mean - 1
+		}
+		return mean + 1
+	}
+	return mean
+}
+
+// maxRunFanIn bounds amount of spilled runs opened at once while they're merged
+const maxRunFanIn = 64
+
+// groupTable holds partial aggregates of urls in memory;
+// when amount of groups exceeds `maxGroups`, groups are sorted by url
+// and spilled to the temporary file (run), so the memory stays bounded
+type groupTable struct {
+	groups    map[string]*group
+	maxGroups int
+	values    record.ValueFormat
+	runs      []string
+}
+
+func newGroupTable(maxGroups int, values record.ValueFormat) *groupTable {
+	return &groupTable{
+		groups:    make(map[string]*group),
+		maxGroups: maxGroups,
+		values:    values,
+	}
+}
+
+func (t *groupTable) add(url string, g group) error {
+	if existing, ok := t.groups[url]; ok {
+		if err := existing.merge(g, t.values); err != nil {
+			return fmt.Errorf("%w: url `%v`", err, url)
+		}
+		return nil
+	}
+	t.groups[url] = &g
+	if t.maxGroups > 0 && len(t.groups) >= t.maxGroups {
+		return t.spill()
+	}
+	return nil
+}
+
+// absorb moves all groups and runs of the other table into the current one
+func (t *groupTable) absorb(other *groupTable) error {
+	t.runs = append(t.runs, other.runs...)
+	other.runs = nil
+	for url, g := range other.groups {
+		if err := t.add(url, *g); err != nil {
+			return err
+		}
+	}
+	other.groups = make(map[string]*group)
+	return nil
+}
+
+func (t *groupTable) spill() error {
+	if len(t.groups) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(t.groups))
+	for url := range t.groups {
+		keys = append(keys, url)
+	}
+	sort.Strings(keys)
+	w, err := t.createRun()
+	if err != nil {
+		return err
+	}
+	for _, url := range keys {
+		w.write(url, *t.groups[url])
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+	t.groups = make(map[string]*group)
+	return nil
+}
+
+// createRun creates the temporary file for the new run, it's removed by `cleanup`
+func (t *groupTable) createRun() (*runWriter, error) {
+	f, err := os.CreateTemp("", "filereader-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	t.runs = append(t.runs, f.Name())
+	return &runWriter{f: f, w: bufio.NewWriter(f), buf: make([]byte, binary.MaxVarintLen64)}, nil
+}
+
+// each calls `fn` for every fully aggregated url;
+// spilled runs are k-way merged, so every url is visited exactly once;
+// no more than `maxRunFanIn` runs are opened at once, so runs are merged in several passes if needed
+func (t *groupTable) each(fn func(url string, g group) error) error {
+	if len(t.runs) == 0 {
+		for url, g := range t.groups {
+			if err := fn(url, *g); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := t.spill(); err != nil {
+		return err
+	}
+	for len(t.runs) > maxRunFanIn {
+		if err := t.compact(); err != nil {
+			return err
+		}
+	}
+	return t.mergeRuns(t.runs, fn)
+}
+
+// compact merges the first `maxRunFanIn` runs into the single one and removes them
+func (t *groupTable) compact() error {
+	merged := t.runs[:maxRunFanIn]
+	t.runs = append([]string{}, t.runs[maxRunFanIn:]...)
+	defer func() {
+		for _, path := range merged {
+			os.Remove(path)
+		}
+	}()
+	w, err := t.createRun()
+	if err != nil {
+		return err
+	}
+	err = t.mergeRuns(merged, func(url string, g group) error {
+		w.write(url, g)
+		return nil
+	})
+	if closeErr := w.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// mergeRuns k-way merges the runs and calls `fn` with the groups of the same url merged
+func (t *groupTable) mergeRuns(paths []string, fn func(url string, g group) error) error {
+	readers := make([]*runReader, 0, len(paths))
+	defer func() {
+		for _, r := range readers {
+			r.f.Close()
+		}
+	}()
+	for _, path := range paths {
+		r, err := openRun(path)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+	}
+	active := make([]*runReader, 0, len(readers))
+	for _, r := range readers {
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			active = append(active, r)
+		}
+	}
+	h := heap.NewHeap(func(a, b *runReader) bool { return a.url < b.url }, len(active), active)
+	for h.Len() > 0 {
+		r := h.Pop()
+		url, g := r.url, r.g
+		for {
+			ok, err := r.next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				h.Push(r)
+			}
+			if h.Len() == 0 {
+				break
+			}
+			r = h.Pop()
+			if r.url != url {
+				h.Push(r)
+				break
+			}
+			if err := g.merge(r.g, t.values); err != nil {
+				return fmt.Errorf("%w: url `%v`", err, url)
+			}
+		}
+		if err := fn(url, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanup removes all spilled runs
+func (t *groupTable) cleanup() {
+	for _, path := range t.runs {
+		os.Remove(path)
+	}
+	t.runs = nil
+}
+
+// runWriter writes groups sorted by url to the run file
+type runWriter struct {
+	f   *os.File
+	w   *bufio.Writer
+	buf []byte
+}
+
+// write adds the group to the run, write errors are returned by `close`
+func (w *runWriter) write(url string, g group) {
+	for _, v := range []int64{
+		int64(len(url)), g.sum, g.count, g.max, g.min,
+		int64(math.Float64bits(g.fsum)), int64(math.Float64bits(g.fmax)), int64(math.Float64bits(g.fmin)),
+		int64(g.source), g.offset, int64(g.lastSource), g.lastOffset,
+	} {
+		n := binary.PutVarint(w.buf, v)
+		w.w.Write(w.buf[:n])
+	}
+	w.w.WriteString(url)
+}
+
+func (w *runWriter) close() error {
+	err := w.w.Flush()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type runReader struct {
+	f   *os.File
+	r   *bufio.Reader
+	url string
+	g   group
+}
+
+func openRun(path string) (*runReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &runReader{f: f, r: bufio.NewReader(f)}, nil
+}
+
+// next reads the next group from the run, returns false when the run is exhausted
+func (r *runReader) next() (bool, error) {
+	urlLen, err := binary.ReadVarint(r.r)
+	if err != nil {
+		if err == stdio.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	vals := make([]int64, 11)
+	for i := range vals {
+		vals[i], err = binary.ReadVarint(r.r)
+		if err != nil {
+			return false, fmt.Errorf("error: corrupted spill file `%v`: %w", r.f.Name(), err)
+		}
+	}
+	url := make([]byte, urlLen)
+	if _, err := stdio.ReadFull(r.r, url); err != nil {
+		return false, fmt.Errorf("error: corrupted spill file `%v`: %w", r.f.Name(), err)
+	}
+	r.url = string(url)
+	r.g = group{
+		sum:        vals[0],
+		count:      vals[1],
+		max:        vals[2],
+		min:        vals[3],
+		fsum:       math.Float64frombits(uint64(vals[4])),
+		fmax:       math.Float64frombits(uint64(vals[5])),
+		fmin:       math.Float64frombits(uint64(vals[6])),
+		source:     int(vals[7]),
+		offset:     vals[8],
+		lastSource: int(vals[9]),
+		lastOffset: vals[10],
+	}
+	return true, nil
+}
@@ -0,0 +1,159 @@
+package ranker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+)
+
+func TestParseAggregate(t *testing.T) {
+	for a, name := range aggregateNames {
+		parsed, err := ParseAggregate(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != a {
+			t.Fatalf("Expected: %v, but got: %v\n", a, parsed)
+		}
+	}
+	a, err := ParseAggregate("AVG")
+	if err != nil || a != AggregateMean {
+		t.Fatalf("`avg` should be parsed as mean, but got: %v, %v\n", a, err)
+	}
+	_, err = ParseAggregate("median")
+	if err == nil {
+		t.Fatal()
+	}
+}
+
+func TestGroupTableSpill(t *testing.T) {
+	nUrls := 50
+	inMemory := newGroupTable(0, record.ValueFormat{})
+	spilled := newGroupTable(7, record.ValueFormat{})
+	defer spilled.cleanup()
+	for i := 0; i < 1000; i++ {
+		rec := record.Record{
+			Url:    fmt.Sprintf("http://api.tech.com/item/%v", i%nUrls),
+			Value:  int64(i),
+			Offset: int64(i),
+		}
+		if err := inMemory.add(rec.Url, newGroup(rec)); err != nil {
+			t.Fatal(err)
+		}
+		if err := spilled.add(rec.Url, newGroup(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(spilled.runs) == 0 {
+		t.Fatal("Groups should be spilled to disk")
+	}
+	runs := append([]string{}, spilled.runs...)
+	visited := make(map[string]bool)
+	err := spilled.each(func(url string, g group) error {
+		if visited[url] {
+			t.Fatalf("Url `%v` visited twice", url)
+		}
+		visited[url] = true
+		if *inMemory.groups[url] != g {
+			t.Fatalf("Expected: %v, but got: %v\n", *inMemory.groups[url], g)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != nUrls {
+		t.Fatalf("Expected %v urls, but got %v", nUrls, len(visited))
+	}
+	spilled.cleanup()
+	for _, path := range runs {
+		if _, err := os.Stat(path); err == nil {
+			t.Fatalf("Spill file `%v` should be removed", path)
+		}
+	}
+}
+
+func TestGroupTableMultiPassMerge(t *testing.T) {
+	nUrls := 1000
+	table := newGroupTable(2, record.ValueFormat{})
+	defer table.cleanup()
+	for i := 0; i < 3*nUrls; i++ {
+		rec := record.Record{Url: fmt.Sprintf("http://api.tech.com/item/%v", i%nUrls), Value: int64(i)}
+		if err := table.add(rec.Url, newGroup(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(table.runs) <= 4*maxRunFanIn {
+		t.Fatalf("Expected more than %v runs, but got %v", 4*maxRunFanIn, len(table.runs))
+	}
+	visited := make(map[string]bool)
+	err := table.each(func(url string, g group) error {
+		var i int
+		fmt.Sscanf(url, "http://api.tech.com/item/%d", &i)
+		if visited[url] || g.count != 3 || g.sum != int64(3*i+3*nUrls) {
+			t.Fatalf("Expected url `%v` visited once with 3 values summed, but got %+v", url, g)
+		}
+		visited[url] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != nUrls {
+		t.Fatalf("Expected %v urls, but got %v", nUrls, len(visited))
+	}
+	// runs merged by the intermediate passes are removed right away
+	if len(table.runs) > maxRunFanIn {
+		t.Fatalf("Expected no more than %v runs left, but got %v", maxRunFanIn, len(table.runs))
+	}
+}
+
+func TestGroupOverflow(t *testing.T) {
+	for _, value := range []int64{math.MaxInt64, math.MinInt64} {
+		g := newGroup(record.Record{Value: value})
+		if err := g.merge(newGroup(record.Record{Value: value}), record.ValueFormat{}); !errors.Is(err, ErrOverflow) {
+			t.Fatalf("Expected `%v` for sum of %v, but got `%v`", ErrOverflow, value, err)
+		}
+	}
+	g := newGroup(record.Record{Value: math.MaxInt64 - 1})
+	if err := g.merge(newGroup(record.Record{Value: 1}), record.ValueFormat{}); err != nil || g.sum != math.MaxInt64 {
+		t.Fatalf("Expected sum %v, but got %v: %v", int64(math.MaxInt64), g.sum, err)
+	}
+	// count is scaled by 10^scale for decimals
+	g = group{count: math.MaxInt64 / 100}
+	decimals := record.ValueFormat{Type: record.ValueDecimal, Scale: 2}
+	if rec, err := g.value(AggregateCount, decimals); err != nil || rec.Value != g.count*100 {
+		t.Fatalf("Expected count %v, but got %v: %v", g.count*100, rec.Value, err)
+	}
+	g.count++
+	if _, err := g.value(AggregateCount, decimals); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("Expected `%v`, but got `%v`", ErrOverflow, err)
+	}
+}
+
+func TestProcessFileAggregateOverflow(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	data := fmt.Sprintf("http://api.tech.com/item/1  %v\nhttp://api.tech.com/item/2  1\nhttp://api.tech.com/item/1  1\n", int64(math.MaxInt64))
+	if err := os.WriteFile(fpath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, maxGroups := range []int{0, 1} {
+		_, err := ProcessFiles(context.Background(), []string{fpath}, Options{
+			BufSize:   bufSize,
+			NWorkers:  2,
+			TopK:      2,
+			Aggregate: AggregateSum,
+			MaxGroups: maxGroups,
+			Retries:   1,
+		})
+		if !errors.Is(err, ErrOverflow) {
+			t.Fatalf("Expected `%v` with %v max groups, but got `%v`", ErrOverflow, maxGroups, err)
+		}
+	}
+}
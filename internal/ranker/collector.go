@@ -0,0 +1,170 @@
+package ranker
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+	"github.com/gasparian/clickhouse-test-file-reader/pkg/heap"
+)
+
+// collector keeps k best ranked records in the bounded heap and, optionally,
+// all the records evicted from it which are tied by value with the k-th one
+type collector struct {
+	heap        *heap.InvertedBoundedHeap[record.Record]
+	comp        func(a, b record.Record) bool
+	includeTies bool
+	// evicted records with the best value seen among evictions so far;
+	// values of evicted records only grow in rank, since the heap top does,
+	// so only the last group can be tied with the final k-th record
+	ties []record.Record
+}
+
+func newCollector(comp func(a, b record.Record) bool, topK int, includeTies bool) *collector {
+	return &collector{
+		heap:        heap.NewHeap(comp, topK, nil),
+		comp:        comp,
+		includeTies: includeTies,
+	}
+}
+
+func (c *collector) push(rec record.Record) {
+	evicted, ok := c.heap.PushPop(rec)
+	if ok && c.includeTies {
+		c.keepTie(evicted)
+	}
+}
+
+// admits checks by the value only whether the record could be kept, so records which can't
+// are dropped before their url is materialized; `worseValue` should match the comparator
+func (c *collector) admits(rec record.Record, worseValue func(a, b record.Record) bool) bool {
+	top, ok := c.threshold()
+	// records tied by value are ranked by the tie-break, which may need the url
+	return !ok || !worseValue(rec, top)
+}
+
+// threshold returns the worst kept record once the collector is full
+func (c *collector) threshold() (record.Record, bool) {
+	if c.heap.Len() < c.heap.MaxSize() {
+		return record.Record{}, false
+	}
+	return c.heap.Peek()
+}
+
+func (c *collector) keepTie(rec record.Record) {
+	if len(c.ties) > 0 {
+		if record.SameValue(rec, c.ties[0]) {
+			c.ties = append(c.ties, rec)
+			return
+		}
+		// evicted record is ranked lower than the kept ones by value
+		if c.comp(rec, c.ties[0]) {
+			return
+		}
+		c.ties = c.ties[:0]
+	}
+	c.ties = append(c.ties, rec)
+}
+
+// resize changes amount of kept records, the worst records are evicted if it's decreased
+func (c *collector) resize(topK int) {
+	for _, rec := range c.heap.SetMaxSize(topK) {
+		if c.includeTies {
+			c.keepTie(rec)
+		}
+	}
+}
+
+// merge moves all records of the other collector into the current one
+func (c *collector) merge(other *collector) {
+	var evicted func(record.Record)
+	if c.includeTies {
+		evicted = c.keepTie
+	}
+	c.heap.MergeFunc(other.heap, evicted)
+	for _, rec := range other.ties {
+		c.push(rec)
+	}
+}
+
+// mergeCollectors merges collectors pairwise in parallel, like a tournament tree,
+// the result is kept in the first collector, which is returned
+func mergeCollectors(collectors []*collector) *collector {
+	for len(collectors) > 1 {
+		half := (len(collectors) + 1) / 2
+		var wg sync.WaitGroup
+		for i := half; i < len(collectors); i++ {
+			wg.Add(1)
+			go func(dst, src *collector) {
+				defer wg.Done()
+				dst.merge(src)
+			}(collectors[i-half], collectors[i])
+		}
+		wg.Wait()
+		collectors = collectors[:half]
+	}
+	return collectors[0]
+}
+
+// result drains the heap and returns records in rank order, best records first;
+// if ties are included, records tied with the k-th one are appended in the end
+func (c *collector) result() []record.Record {
+	result := c.heap.Drain()
+	if !c.includeTies || len(c.ties) == 0 || len(result) == 0 {
+		return result
+	}
+	kth := result[len(result)-1]
+	ties := make([]record.Record, 0, len(c.ties))
+	for _, rec := range c.ties {
+		if record.SameValue(rec, kth) {
+			ties = append(ties, rec)
+		}
+	}
+	sort.Slice(ties, func(i, j int) bool {
+		return c.comp(ties[j], ties[i])
+	})
+	return append(result, ties...)
+}
+
+// sharedBound holds the best k-th value among all the full collectors of the run:
+// the final k-th value can't be worse than the k-th value of any part of the inputs,
+// so records with worse values can be dropped by every worker, even with the empty collector;
+// the bound is valid only for the k it was found with, so it's ignored by collectors of other size
+type sharedBound struct {
+	// v holds *boundValue, pointers are compared by CompareAndSwap, so NaN values are fine
+	v atomic.Value
+}
+
+type boundValue struct {
+	rec  record.Record
+	topK int
+}
+
+func (b *sharedBound) load(topK int) (record.Record, bool) {
+	bound, ok := b.v.Load().(*boundValue)
+	if !ok || bound == nil || bound.topK != topK {
+		return record.Record{}, false
+	}
+	return bound.rec, true
+}
+
+// raise updates the bound if the value of the record is better than the current one,
+// the bound found with another k is replaced
+func (b *sharedBound) raise(rec record.Record, topK int, worseValue func(a, b record.Record) bool) {
+	for {
+		old := b.v.Load()
+		if current, ok := old.(*boundValue); ok && current != nil && current.topK == topK && !worseValue(current.rec, rec) {
+			return
+		}
+		// only the value is needed
+		if b.v.CompareAndSwap(old, &boundValue{rec: record.Record{Value: rec.Value, Float: rec.Float}, topK: topK}) {
+			return
+		}
+	}
+}
+
+// reset drops the bound, e.g. once k is changed
+func (b *sharedBound) reset() {
+	b.v.Store((*boundValue)(nil))
+}
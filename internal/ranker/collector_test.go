@@ -0,0 +1,164 @@
+package ranker
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+)
+
+func bruteForceRank(records []record.Record, comp func(a, b record.Record) bool, topK int, includeTies bool) []record.Record {
+	sorted := append([]record.Record{}, records...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return comp(sorted[j], sorted[i])
+	})
+	if len(sorted) <= topK {
+		return sorted
+	}
+	n := topK
+	for includeTies && n < len(sorted) && record.SameValue(sorted[n], sorted[topK-1]) {
+		n++
+	}
+	return sorted[:n]
+}
+
+func TestCollector(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	records := make([]record.Record, 1000)
+	for i := range records {
+		records[i] = record.Record{
+			Url:    fmt.Sprintf("http://api.tech.com/item/%v", rnd.Intn(100)),
+			Value:  int64(rnd.Intn(20)),
+			Offset: int64(i),
+		}
+	}
+	for _, order := range []Order{OrderDesc, OrderAsc} {
+		for _, tieBreak := range []TieBreak{TieBreakFirst, TieBreakLast, TieBreakURL} {
+			for _, includeTies := range []bool{false, true} {
+				comp := newComparator(order, tieBreak, record.ValueFormat{})
+				topK := 7
+				gt := bruteForceRank(records, comp, topK, includeTies)
+				final := newCollector(comp, topK, includeTies)
+				// split records between several collectors as workers do
+				parts := make([]*collector, 0)
+				for i := 0; i < len(records); i += 150 {
+					end := i + 150
+					if end > len(records) {
+						end = len(records)
+					}
+					c := newCollector(comp, topK, includeTies)
+					part := newCollector(comp, topK, includeTies)
+					for _, rec := range records[i:end] {
+						c.push(rec)
+						part.push(rec)
+					}
+					final.merge(c)
+					parts = append(parts, part)
+				}
+				// collectors reduced pairwise should give the same result as merged one by one
+				for _, res := range [][]record.Record{final.result(), mergeCollectors(parts).result()} {
+					if len(res) != len(gt) {
+						t.Fatalf("%v, %v, ties %v: expected %v records, but got %v", order, tieBreak, includeTies, len(gt), len(res))
+					}
+					for i := range res {
+						if res[i] != gt[i] {
+							t.Fatalf("%v, %v, ties %v: expected `%v`, but got `%v`", order, tieBreak, includeTies, gt[i], res[i])
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCollectorEmpty(t *testing.T) {
+	c := newCollector(newComparator(OrderDesc, TieBreakFirst, record.ValueFormat{}), 3, true)
+	if len(c.result()) != 0 {
+		t.Fatal("Result should be empty")
+	}
+}
+
+func TestCollectorFloats(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	special := []float64{math.NaN(), math.Inf(1), math.Inf(-1), 0.5, -0.5}
+	records := make([]record.Record, 500)
+	for i := range records {
+		value := float64(rnd.Intn(10)) / 4
+		if rnd.Intn(5) == 0 {
+			value = special[rnd.Intn(len(special))]
+		}
+		records[i] = record.Record{
+			Url:    fmt.Sprintf("http://api.tech.com/item/%v", i),
+			Float:  value,
+			Offset: int64(i),
+		}
+	}
+	for _, nan := range []record.NaNPolicy{record.NaNLowest, record.NaNHighest} {
+		for _, order := range []Order{OrderDesc, OrderAsc} {
+			comp := newComparator(order, TieBreakFirst, record.ValueFormat{Type: record.ValueFloat, NaN: nan})
+			topK := 25
+			gt := bruteForceRank(records, comp, topK, true)
+			final := newCollector(comp, topK, true)
+			for i := 0; i < len(records); i += 100 {
+				c := newCollector(comp, topK, true)
+				for _, rec := range records[i : i+100] {
+					c.push(rec)
+				}
+				final.merge(c)
+			}
+			res := final.result()
+			if len(res) != len(gt) {
+				t.Fatalf("%v, %v: expected %v records, but got %v", nan, order, len(gt), len(res))
+			}
+			for i := range res {
+				if res[i].Url != gt[i].Url {
+					t.Fatalf("%v, %v: expected `%v`, but got `%v`", nan, order, gt[i], res[i])
+				}
+			}
+		}
+	}
+}
+
+func TestSharedBound(t *testing.T) {
+	worseValue := newValueComparator(OrderDesc, record.ValueFormat{Type: record.ValueFloat, NaN: record.NaNHighest})
+	var bound sharedBound
+	topK := 10
+	if _, ok := bound.load(topK); ok {
+		t.Fatal("Expected no bound")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				bound.raise(record.Record{Url: "http://api.tech.com/item/1", Float: float64(i*1000 + j)}, topK, worseValue)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if rec, _ := bound.load(topK); rec.Float != 7999 || rec.Url != "" {
+		t.Fatalf("Expected bound 7999 but got %v", rec)
+	}
+	bound.raise(record.Record{Float: math.NaN()}, topK, worseValue)
+	bound.raise(record.Record{Float: math.Inf(1)}, topK, worseValue)
+	if rec, _ := bound.load(topK); !math.IsNaN(rec.Float) {
+		t.Fatalf("Expected NaN bound but got %v", rec)
+	}
+	// bound found with another k is ignored and replaced
+	if _, ok := bound.load(topK + 1); ok {
+		t.Fatal("Expected no bound for another k")
+	}
+	bound.raise(record.Record{Float: 1}, topK+1, worseValue)
+	if rec, ok := bound.load(topK + 1); !ok || rec.Float != 1 {
+		t.Fatalf("Expected bound 1 but got %v", rec)
+	}
+	bound.reset()
+	if _, ok := bound.load(topK + 1); ok {
+		t.Fatal("Expected no bound after reset")
+	}
+}
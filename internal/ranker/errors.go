@@ -0,0 +1,52 @@
+package ranker
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SegmentError describes the segment which failed to be processed
+type SegmentError struct {
+	Path   string
+	Source int
+	// Start and Len locate the segment in the file, compressed offsets are used for BGZF
+	// and stream offsets for in-memory segments
+	Start int64
+	Len   int64
+	Err   error
+}
+
+func (e SegmentError) Error() string {
+	return fmt.Sprintf("%v:%v+%v: %v", e.Path, e.Start, e.Len, e.Err)
+}
+
+func (e SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// SegmentsError is returned when some segments failed to be processed,
+// so the ranked records would be incomplete
+type SegmentsError struct {
+	// Segments are sorted by their position in the inputs
+	Segments []SegmentError
+}
+
+func newSegmentsError(segments []SegmentError) *SegmentsError {
+	segments = append([]SegmentError{}, segments...)
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].Source != segments[j].Source {
+			return segments[i].Source < segments[j].Source
+		}
+		return segments[i].Start < segments[j].Start
+	})
+	return &SegmentsError{Segments: segments}
+}
+
+func (e *SegmentsError) Error() string {
+	return fmt.Sprintf("error: %v segments failed, the first one: %v", len(e.Segments), e.Segments[0])
+}
+
+// Unwrap returns error of the first failed segment
+func (e *SegmentsError) Unwrap() error {
+	return e.Segments[0]
+}
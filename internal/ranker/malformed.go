@@ -0,0 +1,123 @@
+package ranker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MalformedPolicy defines how lines which can't be parsed are handled
+type MalformedPolicy int
+
+const (
+	// MalformedCount skips malformed lines, counting them in the stats
+	MalformedCount MalformedPolicy = iota
+	// MalformedSkip skips malformed lines silently, without counting
+	MalformedSkip
+	// MalformedFail stops processing as soon as more than `MaxMalformed` lines are malformed
+	MalformedFail
+	// MalformedReject counts malformed lines and writes them to the rejects file
+	MalformedReject
+)
+
+func (p MalformedPolicy) String() string {
+	switch p {
+	case MalformedCount:
+		return "count"
+	case MalformedSkip:
+		return "skip"
+	case MalformedFail:
+		return "fail"
+	case MalformedReject:
+		return "reject"
+	}
+	return fmt.Sprintf("MalformedPolicy(%d)", int(p))
+}
+
+// ParseMalformedPolicy returns policy by its name: `count`, `skip`, `fail` or `reject`
+func ParseMalformedPolicy(name string) (MalformedPolicy, error) {
+	switch strings.ToLower(name) {
+	case "count":
+		return MalformedCount, nil
+	case "skip":
+		return MalformedSkip, nil
+	case "fail":
+		return MalformedFail, nil
+	case "reject":
+		return MalformedReject, nil
+	}
+	return MalformedCount, fmt.Errorf("error: unknown malformed lines policy `%v`", name)
+}
+
+// ErrTooManyMalformed is returned when amount of malformed lines exceeds the limit of `MalformedFail` policy
+var ErrTooManyMalformed = errors.New("error: too many malformed lines")
+
+// maxExamples is amount of malformed lines kept in stats as examples
+const maxExamples = 5
+
+// LineError describes the malformed line
+type LineError struct {
+	Path   string
+	Source int
+	// Offset is a byte offset of the line in the (uncompressed) input
+	Offset int64
+	// Kind is a short name of the error kind, see `record.ErrorKind`
+	Kind string
+	Err  error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("%v:%v: %v", e.Path, e.Offset, e.Err)
+}
+
+// addExample keeps the first malformed lines of the inputs, so examples don't depend on the workers scheduling
+func addExample(examples []LineError, lineErr LineError) []LineError {
+	i := sort.Search(len(examples), func(i int) bool {
+		e := examples[i]
+		return e.Source > lineErr.Source || (e.Source == lineErr.Source && e.Offset > lineErr.Offset)
+	})
+	if i >= maxExamples {
+		return examples
+	}
+	if len(examples) < maxExamples {
+		examples = append(examples, LineError{})
+	}
+	copy(examples[i+1:], examples[i:])
+	examples[i] = lineErr
+	return examples
+}
+
+// rejectsWriter writes malformed lines of all workers to a single file
+// as tab separated path, offset, error kind, error and the line itself
+type rejectsWriter struct {
+	sync.Mutex
+	f *os.File
+	w *bufio.Writer
+}
+
+func newRejectsWriter(fpath string) (*rejectsWriter, error) {
+	f, err := os.Create(fpath)
+	if err != nil {
+		return nil, err
+	}
+	return &rejectsWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (rw *rejectsWriter) write(lineErr LineError, line string) error {
+	rw.Lock()
+	defer rw.Unlock()
+	_, err := fmt.Fprintf(rw.w, "%s\t%d\t%s\t%v\t%s\n", lineErr.Path, lineErr.Offset, lineErr.Kind, lineErr.Err, line)
+	return err
+}
+
+func (rw *rejectsWriter) close() error {
+	err := rw.w.Flush()
+	if closeErr := rw.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
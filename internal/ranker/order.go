@@ -0,0 +1,127 @@
+package ranker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+)
+
+// Order defines ranking direction
+type Order int
+
+const (
+	// OrderDesc ranks highest values first (top k)
+	OrderDesc Order = iota
+	// OrderAsc ranks lowest values first (bottom k)
+	OrderAsc
+)
+
+func (o Order) String() string {
+	switch o {
+	case OrderDesc:
+		return "desc"
+	case OrderAsc:
+		return "asc"
+	}
+	return fmt.Sprintf("Order(%d)", int(o))
+}
+
+// ParseOrder returns order by its name: `desc` (or `top`) and `asc` (or `bottom`)
+func ParseOrder(name string) (Order, error) {
+	switch strings.ToLower(name) {
+	case "desc", "top":
+		return OrderDesc, nil
+	case "asc", "bottom":
+		return OrderAsc, nil
+	}
+	return OrderDesc, fmt.Errorf("error: unknown order `%v`", name)
+}
+
+// TieBreak defines how records with equal values are ranked;
+// whatever option is chosen, ranking is fully deterministic: records which are still equal
+// after the tie-break are ranked by position in the inputs and then by url
+type TieBreak int
+
+const (
+	// TieBreakFirst ranks the record which occurs earlier in the inputs higher
+	TieBreakFirst TieBreak = iota
+	// TieBreakLast ranks the record which occurs later in the inputs higher
+	TieBreakLast
+	// TieBreakURL ranks records in the lexical order of their urls
+	TieBreakURL
+)
+
+func (tb TieBreak) String() string {
+	switch tb {
+	case TieBreakFirst:
+		return "first"
+	case TieBreakLast:
+		return "last"
+	case TieBreakURL:
+		return "url"
+	}
+	return fmt.Sprintf("TieBreak(%d)", int(tb))
+}
+
+// ParseTieBreak returns tie-break by its name: `first`, `last` or `url`
+func ParseTieBreak(name string) (TieBreak, error) {
+	switch strings.ToLower(name) {
+	case "first":
+		return TieBreakFirst, nil
+	case "last":
+		return TieBreakLast, nil
+	case "url":
+		return TieBreakURL, nil
+	}
+	return TieBreakFirst, fmt.Errorf("error: unknown tie-break `%v`", name)
+}
+
+// newComparator returns comparator which puts the worst ranked record on top of the heap:
+// for top k we do min heap instead of max, to maintain heap of constant size,
+// and max heap for bottom k; we then have to reverse order of elements
+// that we get from the heap to get the ranked values
+func newComparator(order Order, tieBreak TieBreak, values record.ValueFormat) func(a, b record.Record) bool {
+	return func(a, b record.Record) bool {
+		if c := values.Compare(a, b); c != 0 {
+			if order == OrderAsc {
+				return c > 0
+			}
+			return c < 0
+		}
+		switch tieBreak {
+		case TieBreakURL:
+			if a.Url != b.Url {
+				return a.Url > b.Url
+			}
+		case TieBreakLast:
+			if a.Source != b.Source || a.Offset != b.Offset {
+				return occursBefore(a, b)
+			}
+		}
+		if a.Source != b.Source || a.Offset != b.Offset {
+			return occursBefore(b, a)
+		}
+		return a.Url > b.Url
+	}
+}
+
+// newValueComparator checks whether value of record `a` is ranked strictly lower than the value of `b`,
+// records with equal values can only be ordered by the full comparator
+func newValueComparator(order Order, values record.ValueFormat) func(a, b record.Record) bool {
+	return func(a, b record.Record) bool {
+		if order == OrderAsc {
+			return values.Compare(a, b) > 0
+		}
+		return values.Compare(a, b) < 0
+	}
+}
+
+// occursBefore checks whether record `a` is located before record `b`,
+// inputs are considered in the order they are processed
+func occursBefore(a, b record.Record) bool {
+	if a.Source != b.Source {
+		return a.Source < b.Source
+	}
+	return a.Offset < b.Offset
+}
@@ -0,0 +1,65 @@
+package ranker
+
+import (
+	"testing"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+)
+
+func TestParseOrder(t *testing.T) {
+	for name, gt := range map[string]Order{"desc": OrderDesc, "TOP": OrderDesc, "asc": OrderAsc, "bottom": OrderAsc} {
+		o, err := ParseOrder(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if o != gt {
+			t.Fatalf("Expected: %v, but got: %v\n", gt, o)
+		}
+	}
+	_, err := ParseOrder("random")
+	if err == nil {
+		t.Fatal()
+	}
+}
+
+func TestParseTieBreak(t *testing.T) {
+	for _, gt := range []TieBreak{TieBreakFirst, TieBreakLast, TieBreakURL} {
+		tb, err := ParseTieBreak(gt.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tb != gt {
+			t.Fatalf("Expected: %v, but got: %v\n", gt, tb)
+		}
+	}
+	_, err := ParseTieBreak("random")
+	if err == nil {
+		t.Fatal()
+	}
+}
+
+func TestComparatorTieBreak(t *testing.T) {
+	a := record.Record{Url: "b", Value: 1, Offset: 0}
+	b := record.Record{Url: "a", Value: 1, Offset: 10}
+	cases := []struct {
+		tieBreak TieBreak
+		// whether `a` should be ranked lower than `b`
+		aIsWorse bool
+	}{
+		{TieBreakFirst, false},
+		{TieBreakLast, true},
+		{TieBreakURL, true},
+	}
+	for _, order := range []Order{OrderDesc, OrderAsc} {
+		for _, c := range cases {
+			comp := newComparator(order, c.tieBreak, record.ValueFormat{})
+			if comp(a, b) != c.aIsWorse || comp(b, a) == c.aIsWorse {
+				t.Fatalf("%v, %v: wrong order of tied records", order, c.tieBreak)
+			}
+		}
+	}
+	comp := newComparator(OrderDesc, TieBreakFirst, record.ValueFormat{})
+	if comp(a, a) {
+		t.Fatal("Record should not be ranked lower than itself")
+	}
+}
@@ -0,0 +1,260 @@
+package ranker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+)
+
+var (
+	// ErrPoolClosed is returned when the job is submitted to the closed pool
+	ErrPoolClosed = errors.New("error: pool is closed")
+	// ErrUnknownJob is returned for jobs which were never submitted, whose results are already taken or expired
+	ErrUnknownJob = errors.New("error: unknown job")
+)
+
+const (
+	// DefaultPoolJobs is amount of jobs processed by the pool at once if it's not set
+	DefaultPoolJobs = 4
+	// DefaultResultTTL is how long results of the finished jobs are kept if it's not set
+	DefaultResultTTL = 10 * time.Minute
+)
+
+// PoolOptions holds parameters of the pool
+type PoolOptions struct {
+	// MaxJobs is amount of jobs processed at once, other jobs wait in the queue
+	MaxJobs int
+	// ResultTTL is how long results of the finished job are kept, they're dropped
+	// if nobody takes them in time, so the long-lived pool doesn't accumulate them
+	ResultTTL time.Duration
+}
+
+// JobID identifies the job submitted to the pool
+type JobID uint64
+
+// JobState is the stage of the job's lifecycle
+type JobState int
+
+const (
+	// JobQueued waits for one of the pool's runners
+	JobQueued JobState = iota
+	// JobRunning is being processed
+	JobRunning
+	// JobFinished is done, its results wait to be taken
+	JobFinished
+)
+
+// JobStatus describes the job submitted to the pool
+type JobStatus struct {
+	State JobState
+	// Started is when the job is taken from the queue, it's zero for queued jobs
+	Started time.Time
+}
+
+// Pool ranks inputs of many jobs over its lifetime: up to `MaxJobs` jobs are processed at once
+// in the order they are submitted, each one with its own options, and workers of all jobs share
+// goroutines and line buffers of the pool; results of the jobs are kept separately until taken or expired
+type Pool struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	queue     []queued
+	jobs      map[JobID]*job
+	lastID    JobID
+	closed    bool
+	resultTTL time.Duration
+	// runners process jobs of the queue, done is closed once all of them exit
+	runners sync.WaitGroup
+	done    chan struct{}
+	tasks   chan func()
+	threads sync.WaitGroup
+	readers lineReaders
+}
+
+// queued is the job waiting to be processed
+type queued struct {
+	id  JobID
+	job *job
+}
+
+type job struct {
+	fpaths  []string
+	opts    Options
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	status  JobStatus
+	records []record.Record
+	stats   *Stats
+	err     error
+	// expiry drops results of the finished job once they're kept for too long
+	expiry *time.Timer
+}
+
+// NewPool creates the pool and starts processing of the submitted jobs
+func NewPool(opts PoolOptions) *Pool {
+	if opts.MaxJobs <= 0 {
+		opts.MaxJobs = DefaultPoolJobs
+	}
+	if opts.ResultTTL <= 0 {
+		opts.ResultTTL = DefaultResultTTL
+	}
+	p := &Pool{
+		jobs:      make(map[JobID]*job),
+		resultTTL: opts.ResultTTL,
+		done:      make(chan struct{}),
+		tasks:     make(chan func()),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.runners.Add(opts.MaxJobs)
+	for i := 0; i < opts.MaxJobs; i++ {
+		go p.run()
+	}
+	go func() {
+		p.runners.Wait()
+		close(p.done)
+	}()
+	return p
+}
+
+// Submit queues the job ranking records of the files together, the same way as ProcessFilesStats does;
+// the job is cancelled along with the context
+func (p *Pool) Submit(ctx context.Context, fpaths []string, opts Options) (JobID, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, ErrPoolClosed
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	j := &job{
+		fpaths: fpaths,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	p.lastID++
+	p.jobs[p.lastID] = j
+	p.queue = append(p.queue, queued{p.lastID, j})
+	p.cond.Signal()
+	return p.lastID, nil
+}
+
+// Result waits for the job to finish and returns its ranked records and statistics,
+// results are returned only once, then the job is forgotten; results which are not taken
+// within `ResultTTL` after the job is finished are dropped
+func (p *Pool) Result(ctx context.Context, id JobID) ([]record.Record, *Stats, error) {
+	p.mu.Lock()
+	j, ok := p.jobs[id]
+	p.mu.Unlock()
+	if !ok {
+		return nil, nil, ErrUnknownJob
+	}
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.jobs[id]; !ok {
+		// results are taken concurrently
+		return nil, nil, ErrUnknownJob
+	}
+	delete(p.jobs, id)
+	j.expiry.Stop()
+	return j.records, j.stats, j.err
+}
+
+// Status returns status of the job, until its results are taken or expired
+func (p *Pool) Status(id JobID) (JobStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	j, ok := p.jobs[id]
+	if !ok {
+		return JobStatus{}, ErrUnknownJob
+	}
+	return j.status, nil
+}
+
+// Close cancels the running and queued jobs and waits for them to finish, then stops
+// goroutines of the pool; results of the finished jobs still can be taken
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.done
+		return
+	}
+	p.closed = true
+	for _, j := range p.jobs {
+		j.cancel()
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	<-p.done
+	close(p.tasks)
+	p.threads.Wait()
+}
+
+// run processes queued jobs one by one until the pool is closed, `MaxJobs` runners work at once
+func (p *Pool) run() {
+	defer p.runners.Done()
+	for {
+		id, j := p.next()
+		if j == nil {
+			return
+		}
+		p.mu.Lock()
+		j.status = JobStatus{State: JobRunning, Started: time.Now()}
+		p.mu.Unlock()
+		j.records, j.stats, j.err = processFiles(j.ctx, j.fpaths, j.opts, p)
+		j.cancel()
+		p.mu.Lock()
+		j.status.State = JobFinished
+		j.expiry = time.AfterFunc(p.resultTTL, func() { p.forget(id) })
+		p.mu.Unlock()
+		close(j.done)
+	}
+}
+
+// forget drops the job along with its results
+func (p *Pool) forget(id JobID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.jobs, id)
+}
+
+// next waits for the next queued job, nil is returned once the pool is closed and the queue is empty
+func (p *Pool) next() (JobID, *job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if len(p.queue) == 0 {
+		return 0, nil
+	}
+	q := p.queue[0]
+	p.queue[0] = queued{}
+	p.queue = p.queue[1:]
+	return q.id, q.job
+}
+
+// spawn runs the function in the idle goroutine of the pool, or in the new one if there is none;
+// goroutine waits for the next function once it's done
+func (p *Pool) spawn(f func()) {
+	select {
+	case p.tasks <- f:
+	default:
+		p.threads.Add(1)
+		go func() {
+			defer p.threads.Done()
+			for ; f != nil; f = <-p.tasks {
+				f()
+			}
+		}()
+	}
+}
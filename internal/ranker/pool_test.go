@@ -0,0 +1,234 @@
+package ranker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/io"
+)
+
+func writePoolInputs(t *testing.T, n int) []string {
+	dir := t.TempDir()
+	fpaths := make([]string, n)
+	for i := range fpaths {
+		var data strings.Builder
+		for j := 0; j < 500; j++ {
+			fmt.Fprintf(&data, "http://api.tech.com/item/%v/%v  %v\n", i, j, (j*31+i)%500)
+		}
+		fpaths[i] = filepath.Join(dir, fmt.Sprintf("input%v", i))
+		if err := os.WriteFile(fpaths[i], []byte(data.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fpaths
+}
+
+func TestPool(t *testing.T) {
+	fpaths := writePoolInputs(t, 4)
+	p := NewPool(PoolOptions{})
+	defer p.Close()
+	opts := make([]Options, 0)
+	ids := make([]JobID, 0)
+	for i, fpath := range fpaths {
+		// every job has its own options
+		o := Options{
+			BufSize:     bufSize,
+			NWorkers:    4,
+			TopK:        i + 1,
+			SegmentSize: 256,
+			Order:       Order(i % 2),
+		}
+		id, err := p.Submit(context.Background(), []string{fpath}, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts = append(opts, o)
+		ids = append(ids, id)
+	}
+	// results are taken in the reverse order
+	for i := len(ids) - 1; i >= 0; i-- {
+		gt, err := ProcessFiles(context.Background(), []string{fpaths[i]}, opts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, err := p.Status(ids[i]); err != nil {
+			t.Fatalf("Job %v: unexpected error `%v`", ids[i], err)
+		} else if status.State != JobQueued && status.Started.IsZero() {
+			t.Fatalf("Job %v: expected start time of the %v job", ids[i], status.State)
+		}
+		res, stats, err := p.Result(context.Background(), ids[i])
+		if err != nil || stats == nil {
+			t.Fatalf("Job %v: unexpected error `%v`", ids[i], err)
+		}
+		if _, err := p.Status(ids[i]); !errors.Is(err, ErrUnknownJob) {
+			t.Fatalf("Job %v: expected unknown job error, but got `%v`", ids[i], err)
+		}
+		if len(res) != len(gt) {
+			t.Fatalf("Job %v: expected %v records, but got %v", ids[i], len(gt), len(res))
+		}
+		for j := range res {
+			if res[j] != gt[j] {
+				t.Fatalf("Job %v: expected `%v`, but got `%v`", ids[i], gt[j], res[j])
+			}
+		}
+		if _, _, err := p.Result(context.Background(), ids[i]); !errors.Is(err, ErrUnknownJob) {
+			t.Fatalf("Job %v: expected unknown job error, but got `%v`", ids[i], err)
+		}
+	}
+}
+
+func TestPoolReusesGoroutines(t *testing.T) {
+	fpaths := writePoolInputs(t, 1)
+	p := NewPool(PoolOptions{})
+	defer p.Close()
+	nJobs, nWorkers := 5, 4
+	for i := 0; i < nJobs; i++ {
+		id, err := p.Submit(context.Background(), fpaths, Options{BufSize: bufSize, NWorkers: nWorkers, TopK: 3, SegmentSize: 256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := p.Result(context.Background(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every started goroutine waits for the next task once it's done, so they are all idle now
+	release := make(chan struct{})
+	idle := 0
+	for {
+		select {
+		case p.tasks <- func() { <-release }:
+			idle++
+			continue
+		default:
+		}
+		break
+	}
+	close(release)
+	if idle == 0 || idle >= nJobs*nWorkers {
+		t.Fatalf("Expected less than %v goroutines, but got %v", nJobs*nWorkers, idle)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	fpaths := writePoolInputs(t, 1)
+	blocked := make(chan struct{})
+	openSegment = func(segment io.FileSegmentPointer, delimiter []byte) (*io.SegmentReader, error) {
+		<-blocked
+		return io.OpenSegment(segment, delimiter)
+	}
+	defer func() { openSegment = io.OpenSegment }()
+	p := NewPool(PoolOptions{})
+	opts := Options{BufSize: bufSize, NWorkers: 2, TopK: 3, SegmentSize: 256}
+	running, err := p.Submit(context.Background(), fpaths, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := p.Submit(context.Background(), fpaths, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the job is cancelled by its context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, err := p.Submit(ctx, fpaths, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	// segments are blocked until jobs are cancelled by closing the pool
+	for isClosed := false; !isClosed; {
+		runtime.Gosched()
+		p.mu.Lock()
+		isClosed = p.closed
+		p.mu.Unlock()
+	}
+	close(blocked)
+	<-closed
+	for _, id := range []JobID{running, queued, cancelled} {
+		if _, _, err := p.Result(context.Background(), id); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Job %v: expected cancellation, but got `%v`", id, err)
+		}
+	}
+	if _, err := p.Submit(context.Background(), fpaths, opts); !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Expected closed pool error, but got `%v`", err)
+	}
+	p.Close()
+}
+
+func TestPoolConcurrentJobs(t *testing.T) {
+	fpaths := writePoolInputs(t, 2)
+	// segments of every job are blocked until both jobs are running
+	var mx sync.Mutex
+	opened := make(map[string]bool)
+	both := make(chan struct{})
+	openSegment = func(segment io.FileSegmentPointer, delimiter []byte) (*io.SegmentReader, error) {
+		mx.Lock()
+		if !opened[segment.Fpath] {
+			opened[segment.Fpath] = true
+			if len(opened) == len(fpaths) {
+				close(both)
+			}
+		}
+		mx.Unlock()
+		select {
+		case <-both:
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("jobs are not processed at once")
+		}
+		return io.OpenSegment(segment, delimiter)
+	}
+	defer func() { openSegment = io.OpenSegment }()
+	p := NewPool(PoolOptions{MaxJobs: 2})
+	defer p.Close()
+	ids := make([]JobID, len(fpaths))
+	for i, fpath := range fpaths {
+		id, err := p.Submit(context.Background(), []string{fpath}, Options{BufSize: bufSize, NWorkers: 2, TopK: 3, SegmentSize: 256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	for _, id := range ids {
+		if res, _, err := p.Result(context.Background(), id); err != nil || len(res) != 3 {
+			t.Fatalf("Job %v: expected 3 records, but got %v: %v", id, res, err)
+		}
+	}
+}
+
+func TestPoolResultTTL(t *testing.T) {
+	fpaths := writePoolInputs(t, 1)
+	p := NewPool(PoolOptions{ResultTTL: time.Millisecond})
+	defer p.Close()
+	id, err := p.Submit(context.Background(), fpaths, Options{BufSize: bufSize, NWorkers: 2, TopK: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// results which are not taken are dropped once the job is finished
+	for i := 0; ; i++ {
+		p.mu.Lock()
+		_, ok := p.jobs[id]
+		p.mu.Unlock()
+		if !ok {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("Expected results of the finished job to expire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, _, err := p.Result(context.Background(), id); !errors.Is(err, ErrUnknownJob) {
+		t.Fatalf("Expected unknown job error, but got `%v`", err)
+	}
+}
@@ -0,0 +1,100 @@
+package ranker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProgressInterval is how often the progress is reported if the interval is not set
+const DefaultProgressInterval = time.Second
+
+// Progress is a snapshot of the run's progress
+type Progress struct {
+	// TotalBytes is the size of all inputs, it's zero if it's unknown, e.g. for stdin
+	// or gzip files, which sizes differ from the size of the decompressed data
+	TotalBytes int64
+	// BytesDone is the size of the processed segments: compressed blocks are counted
+	// for BGZF files and decompressed data for other compressed inputs
+	BytesDone int64
+	// Lines is amount of scanned lines, including empty ones
+	// and the lines scanned by the failed attempts of the retried segments
+	Lines int64
+	// SegmentsEmitted and SegmentsDone count segments handed to the workers and processed by them
+	SegmentsEmitted int64
+	SegmentsDone    int64
+	// Elapsed is the time since the ranker is created
+	Elapsed time.Duration
+}
+
+// Percent returns percentage of the processed bytes, it's zero if the total size is unknown
+func (p Progress) Percent() float64 {
+	if p.TotalBytes <= 0 {
+		return 0
+	}
+	percent := 100 * float64(p.BytesDone) / float64(p.TotalBytes)
+	if percent > 100 {
+		return 100
+	}
+	return percent
+}
+
+// Rate returns amount of bytes processed per second
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.BytesDone) / p.Elapsed.Seconds()
+}
+
+// ETA estimates time left by the current rate, it's zero if it can't be estimated
+func (p Progress) ETA() time.Duration {
+	rate := p.Rate()
+	if p.TotalBytes <= 0 || rate == 0 || p.BytesDone >= p.TotalBytes {
+		return 0
+	}
+	return time.Duration(float64(p.TotalBytes-p.BytesDone) / rate * float64(time.Second))
+}
+
+// progressCounters are updated by the emitter and the workers atomically,
+// lines are added in batches, so the scanning loop isn't slowed down
+type progressCounters struct {
+	totalBytes      int64
+	bytesDone       int64
+	lines           int64
+	segmentsEmitted int64
+	segmentsDone    int64
+}
+
+func (c *progressCounters) snapshot(started time.Time) Progress {
+	// done segments are loaded first, so they never outnumber the emitted ones
+	p := Progress{
+		SegmentsDone: atomic.LoadInt64(&c.segmentsDone),
+		BytesDone:    atomic.LoadInt64(&c.bytesDone),
+		Lines:        atomic.LoadInt64(&c.lines),
+		Elapsed:      time.Since(started),
+	}
+	p.SegmentsEmitted = atomic.LoadInt64(&c.segmentsEmitted)
+	p.TotalBytes = atomic.LoadInt64(&c.totalBytes)
+	return p
+}
+
+// reportProgress calls `fn` with the progress every `interval` until `stop` is closed,
+// then the final progress is reported
+func (r *Ranker) reportProgress(fn func(Progress), interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn(r.Progress())
+		case <-stop:
+			fn(r.Progress())
+			return
+		}
+	}
+}
+
+// Progress returns the current progress of the run
+func (r *Ranker) Progress() Progress {
+	return r.progress.snapshot(r.started)
+}
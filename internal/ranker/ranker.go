@@ -2,28 +2,97 @@ package ranker
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	stdio "io"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gasparian/clickhouse-test-file-reader/internal/io"
 	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
-	"github.com/gasparian/clickhouse-test-file-reader/pkg/heap"
 )
 
-// instead of max we do min here, to maintain heap of constant size
-// we then have to reverse order of elements that we get from the heap
-// to get topk values
-func comparator(a, b record.Record) bool {
-	return a.Value < b.Value
+// how many lines worker scans between context cancellation checks and progress updates
+const ctxCheckInterval = 1024
+
+// MaxWorkers is the max number of workers, since 1024 open files is a soft limit (for Linux)
+const MaxWorkers = 1023
+
+// openSegment opens segments for reading, it's replaced in tests to simulate failures
+var openSegment = io.OpenSegment
+
+// Options holds parameters of the ranking run
+type Options struct {
+	BufSize     int
+	NWorkers    int
+	TopK        int
+	SegmentSize int64
+	// Aggregate combines values of the same url across the whole file before ranking
+	Aggregate Aggregate
+	// MaxGroups bounds amount of distinct urls kept in memory by each worker while aggregating,
+	// partial aggregates are spilled to temporary files above that bound; zero means no bound
+	MaxGroups int
+	// Order defines whether the highest (default) or the lowest values are ranked first
+	Order Order
+	// TieBreak defines how records with equal values are ranked
+	TieBreak TieBreak
+	// IncludeTies makes result include all records tied by value with the k-th one,
+	// so more than k records can be returned
+	IncludeTies bool
+	// Values defines how values are compared and aggregated, it should match values
+	// produced by the parser; integers are expected by default
+	Values record.ValueFormat
+	// Parser parses lines of the inputs, `<url>  <value>` lines are expected by default;
+	// header parsers get bound to the first line of every input, which is not ranked itself
+	Parser record.Parser
+	// Malformed defines how lines which can't be parsed are handled
+	Malformed MalformedPolicy
+	// MaxMalformed is amount of malformed lines tolerated by the `MalformedFail` policy
+	MaxMalformed int
+	// RejectsPath is a file where the `MalformedReject` policy writes malformed lines
+	RejectsPath string
+	// Retries is how many times the failed segment is processed again before giving up
+	Retries int
+	// MaxLineLen limits length of lines, longer lines are handled as malformed ones
+	// without keeping them in memory; zero means no limit, so the line buffer grows as needed
+	MaxLineLen int
+	// ValidateSegments makes sure that segments of plain files tile them exactly,
+	// otherwise an error is returned; it's meant for debugging
+	ValidateSegments bool
+	// Delimiter separates lines of the inputs, it can be longer than a single byte (e.g. `\r\n`);
+	// `\n` is used by default, in that case trailing `\r` of lines is dropped
+	Delimiter []byte
+	// Mmap makes plain files be mapped into memory once instead of reading every segment
+	// separately, so workers get segments as slices of the mapping; it's supported only on Linux
+	Mmap bool
+	// OnProgress is called with the progress of the run every `ProgressInterval`
+	// (DefaultProgressInterval if it's not set) and once all the workers are finished
+	OnProgress       func(Progress)
+	ProgressInterval time.Duration
 }
 
 type rankerConfig struct {
 	sync.RWMutex
-	topK     int
-	nWorkers int
+	topK             int
+	nWorkers         int
+	aggregate        Aggregate
+	maxGroups        int
+	order            Order
+	tieBreak         TieBreak
+	includeTies      bool
+	values           record.ValueFormat
+	parser           record.Parser
+	malformed        MalformedPolicy
+	maxMalformed     int
+	retries          int
+	maxLineLen       int
+	validateSegments bool
+	delimiter        []byte
+	mmap             bool
 }
 
 func (rc *rankerConfig) getTopK() int {
@@ -32,154 +101,1080 @@ func (rc *rankerConfig) getTopK() int {
 	return rc.topK
 }
 
+func (rc *rankerConfig) getWorkers() int {
+	rc.RLock()
+	defer rc.RUnlock()
+	return rc.nWorkers
+}
+
+// clampWorkers limits number of workers by MaxWorkers, the warning is returned if it's decreased
+func clampWorkers(nWorkers int) (int, string) {
+	if nWorkers > MaxWorkers {
+		return MaxWorkers, fmt.Sprintf("number of workers decreased from %v to %v, since 1024 is a soft limit (for Linux)", nWorkers, MaxWorkers)
+	}
+	return nWorkers, ""
+}
+
 // Ranker holds channels for communicating between processing stages
 // and methods for parsing and ranking input text data
 type Ranker struct {
-	inputChan chan io.FileSegmentPointer
-	heapsChan chan *heap.InvertedBoundedHeap[record.Record]
-	config    rankerConfig
+	// nMalformed counts malformed lines of all workers for the `MalformedFail` policy,
+	// it's accessed atomically, so it goes first to be 64-bit aligned along with the progress
+	nMalformed int64
+	progress   progressCounters
+	started    time.Time
+	inputChan  chan io.FileSegmentPointer
+	heapsChan  chan *collector
+	groupsChan chan *groupTable
+	config     rankerConfig
+	comparator func(a, b record.Record) bool
+	// worseValue compares only values of records in the same direction as the comparator
+	worseValue func(a, b record.Record) bool
+	// bound is the best k-th value among the segments processed so far
+	bound sharedBound
+	// parsers holds parsers bound to the inputs, indexed by the source;
+	// parser is set before segments of its input are emitted
+	parsers []record.Parser
+	// emitErr holds an error occurred while splitting inputs into segments,
+	// it's safe to read it only after emitDone is closed
+	emitErr error
+	// emitDone is closed once the emitter exits; it may outlive the workers if the run is cancelled
+	// while the emitter is blocked reading the input
+	emitDone chan struct{}
+	// mapped holds memory-mapped inputs, they're unmapped once both the workers and the emitter are finished
+	mapped []*io.MappedFile
+	// workers, workersCtx, quits and workersDone manage the worker pool, which can be resized
+	// while the ranker runs; quits holds quit channels of the running workers,
+	// it's guarded by the config lock along with workersDone
+	workers     sync.WaitGroup
+	workersCtx  context.Context
+	quits       []chan struct{}
+	workersDone bool
+	// spawn runs workers, goroutines of the pool are reused if the ranker runs the pool's job
+	spawn func(func())
+	// readers reuses line readers along with their buffers across segments
+	readers *lineReaders
+	rejects *rejectsWriter
+	statsMu sync.Mutex
+	stats   *Stats
+	// workersFinished is set once all workers exit, merge time is measured from it
+	workersFinished time.Time
+	// failedSegments holds segments which failed to be processed after all retries
+	failedSegments []SegmentError
+	// err holds the error which stopped the workers, it's set once by `fail`
+	err      error
+	failOnce sync.Once
+	failed   chan struct{}
+	cancel   context.CancelFunc
 }
 
-func (r *Ranker) processSegment(fileSegment io.FileSegmentPointer) (*heap.InvertedBoundedHeap[record.Record], error) {
-	f, err := os.Open(fileSegment.Fpath)
-	if err != nil {
-		return nil, err
+// lineReader splits the segment into lines
+type lineReader interface {
+	ReadLine() ([]byte, int, error)
+}
+
+// lineReaders keeps line readers released after reading segments, so their buffers are reused
+type lineReaders struct {
+	pool sync.Pool
+}
+
+func (p *lineReaders) get(r stdio.Reader, bufSize, maxLen int, delimiter []byte) *io.LineReader {
+	if lr, ok := p.pool.Get().(*io.LineReader); ok && lr.Size() >= bufSize {
+		lr.Reset(r, maxLen, delimiter)
+		return lr
 	}
-	defer f.Close()
-	f.Seek(fileSegment.Start, 0)
-	s := bufio.NewScanner(f)
-	buf := make([]byte, 0)
-	s.Buffer(buf, fileSegment.BufSize)
-	var nBytesRead int64 = 0
-	h := heap.NewHeap(comparator, r.config.getTopK(), nil)
-	for s.Scan() {
-		text := s.Text()
-		if len(text) > 0 {
-			record, err := record.ParseRecord(text)
+	return io.NewLineReader(r, bufSize, maxLen, delimiter)
+}
+
+func (p *lineReaders) put(lr *io.LineReader) {
+	// reader shouldn't keep the segment's file
+	lr.Reset(nil, 0, nil)
+	p.pool.Put(lr)
+}
+
+// scanSegment reads records of the file segment one by one and passes them to `fn`,
+// malformed lines are handled according to the policy and counted in the worker's `stats`;
+// if the parser supports raw parsing, records not accepted by `admit` are dropped
+// before their urls are materialized, nil `admit` accepts all records
+func (r *Ranker) scanSegment(ctx context.Context, fileSegment io.FileSegmentPointer, stats *Stats,
+	admit func(record.Record) bool, fn func(record.Record) error) error {
+	var lines lineReader
+	offset := fileSegment.Start
+	if fileSegment.Data != nil {
+		// in-memory segments are split in place, without copying them through the buffer
+		lines = io.NewSliceLineReader(fileSegment.Data, r.config.maxLineLen, r.config.delimiter)
+	} else {
+		reader, err := openSegment(fileSegment, r.config.delimiter)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		lr := r.readers.get(reader, fileSegment.BufSize, r.config.maxLineLen, r.config.delimiter)
+		defer r.readers.put(lr)
+		lines = lr
+		offset = reader.Offset
+	}
+	parser := r.parsers[fileSegment.Source]
+	rawParser, isRaw := parser.(record.RawParser)
+	valueParser, isValue := parser.(record.ValueParser)
+	// lines dropped by the value alone are not validated, so it's only done
+	// when malformed lines are skipped silently anyway
+	dropByValue := isValue && admit != nil && r.config.malformed == MalformedSkip
+	_, hasHeader := r.config.parser.(record.HeaderParser)
+	var nLines, nEmpty, nParsed int64 = 0, 0, 0
+	defer func() {
+		atomic.AddInt64(&r.progress.lines, nLines%ctxCheckInterval)
+		stats.Lines += nLines
+		stats.EmptyLines += nEmpty
+		stats.Parsed += nParsed
+	}()
+	for {
+		line, n, err := lines.ReadLine()
+		if err == stdio.EOF {
+			break
+		}
+		if err != nil && err != io.ErrLineTooLong {
+			return err
+		}
+		nLines++
+		if nLines%ctxCheckInterval == 0 {
+			atomic.AddInt64(&r.progress.lines, ctxCheckInterval)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		lineOffset := offset
+		offset += int64(n)
+		if err == io.ErrLineTooLong {
+			lineErr := fmt.Errorf("%w: longer than %v bytes", record.ErrOversized, r.config.maxLineLen)
+			if err := r.malformed(stats, fileSegment, lineOffset, string(line), lineErr); err != nil {
+				return err
+			}
+		} else if len(line) == 0 {
+			nEmpty++
+		} else if !(hasHeader && lineOffset == 0) {
+			// header is the very first line of the input
+			line = io.TrimCR(line, r.config.delimiter)
+			if dropByValue {
+				if rec, ok := valueParser.ParseValue(line); ok && !admit(rec) {
+					// only the value is parsed, but the line is counted as parsed anyway
+					nParsed++
+					continue
+				}
+			}
+			var (
+				rec record.Record
+				url []byte
+				err error
+			)
+			if isRaw {
+				rec, url, err = rawParser.ParseRaw(line)
+			} else {
+				rec, err = parser.Parse(string(line))
+			}
 			if err != nil {
-				log.Println("Warning: line parsing failed with error: ", err)
+				if err := r.malformed(stats, fileSegment, lineOffset, string(line), err); err != nil {
+					return err
+				}
 				continue
 			}
-			h.Push(record)
+			nParsed++
+			rec.Offset = lineOffset
+			rec.Source = fileSegment.Source
+			if isRaw {
+				if admit != nil && !admit(rec) {
+					continue
+				}
+				rec.Url = string(url)
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
 		}
-		if err := s.Err(); err != nil {
-			return nil, err
+	}
+	return nil
+}
+
+func (r *Ranker) malformed(stats *Stats, fileSegment io.FileSegmentPointer, offset int64, line string, err error) error {
+	if r.config.malformed == MalformedSkip {
+		return nil
+	}
+	lineErr := LineError{
+		Path:   fileSegment.Fpath,
+		Source: fileSegment.Source,
+		Offset: offset,
+		Kind:   record.ErrorKind(err),
+		Err:    err,
+	}
+	stats.addMalformed(lineErr)
+	switch r.config.malformed {
+	case MalformedFail:
+		if atomic.AddInt64(&r.nMalformed, 1) > int64(r.config.maxMalformed) {
+			return fmt.Errorf("%w: more than %v, the last one at %v", ErrTooManyMalformed, r.config.maxMalformed, lineErr)
 		}
-		nBytesRead += int64(len(s.Bytes()))
-		if nBytesRead >= fileSegment.Len {
-			break
+	case MalformedReject:
+		if err := r.rejects.write(lineErr, line); err != nil {
+			return fmt.Errorf("error: cannot write rejected line: %w", err)
+		}
+	}
+	return nil
+}
+
+// fail stops the workers and the emitter, only the first error is kept
+func (r *Ranker) fail(err error) {
+	r.failOnce.Do(func() {
+		r.err = err
+		close(r.failed)
+		r.cancel()
+	})
+}
+
+// Stats returns statistics of the run, it should be called only after the ranked records are returned
+func (r *Ranker) Stats() *Stats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
+func (r *Ranker) mergeStats(stats *Stats) {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	r.stats.merge(stats)
+}
+
+func (r *Ranker) newCollector() *collector {
+	return newCollector(r.comparator, r.config.getTopK(), r.config.includeTies)
+}
+
+// processSegment pushes records of the segment into the collector
+func (r *Ranker) processSegment(ctx context.Context, fileSegment io.FileSegmentPointer, c *collector, stats *Stats) error {
+	topK := c.heap.MaxSize()
+	admit := func(rec record.Record) bool {
+		if bound, ok := r.bound.load(topK); ok && r.worseValue(rec, bound) {
+			return false
 		}
+		return c.admits(rec, r.worseValue)
 	}
-	return h, nil
+	return r.scanSegment(ctx, fileSegment, stats, admit, func(rec record.Record) error {
+		c.push(rec)
+		if top, ok := c.threshold(); ok {
+			r.bound.raise(top, topK, r.worseValue)
+		}
+		return nil
+	})
+}
+
+// collectSegment adds records of the segment to the worker's collector
+func (r *Ranker) collectSegment(ctx context.Context, fileSegment io.FileSegmentPointer, c *collector, stats *Stats) error {
+	if r.config.retries == 0 {
+		return r.processSegment(ctx, fileSegment, c, stats)
+	}
+	return r.withRetries(ctx, func() error {
+		// segment is collected separately, so records and stats of the failed attempt are dropped
+		segmentCollector := r.newCollector()
+		segmentStats := newStats()
+		if err := r.processSegment(ctx, fileSegment, segmentCollector, segmentStats); err != nil {
+			return err
+		}
+		c.merge(segmentCollector)
+		stats.merge(segmentStats)
+		return nil
+	})
 }
 
-func (r *Ranker) worker(wg *sync.WaitGroup) {
-	for fileSegmentPointer := range r.inputChan {
-		h, err := r.processSegment(fileSegmentPointer)
+// aggregateSegment adds records of the segment to the worker's partial aggregates
+func (r *Ranker) aggregateSegment(ctx context.Context, fileSegment io.FileSegmentPointer, groups *groupTable, stats *Stats) error {
+	return r.scanSegment(ctx, fileSegment, stats, nil, func(rec record.Record) error {
+		return groups.add(rec.Url, newGroup(rec))
+	})
+}
+
+func (r *Ranker) worker(ctx context.Context, quit chan struct{}) {
+	defer r.workers.Done()
+	defer r.stopWorker(quit)
+	stats := newStats()
+	stats.WorkerBusy = make([]time.Duration, 1)
+	defer r.mergeStats(stats)
+	if r.config.aggregate != AggregateNone {
+		r.aggregateWorker(ctx, quit, stats)
+		return
+	}
+	// the heap is kept across all segments the worker handles and emitted once the input channel is closed
+	// or the worker is retired
+	c := r.newCollector()
+	for {
+		fileSegmentPointer, ok := r.nextSegment(ctx, quit)
+		if !ok || ctx.Err() != nil {
+			break
+		}
+		if topK := r.config.getTopK(); topK != c.heap.MaxSize() {
+			// k is changed while the worker runs
+			c.resize(topK)
+		}
+		start := time.Now()
+		err := r.collectSegment(ctx, fileSegmentPointer, c, stats)
+		r.segmentDone(fileSegmentPointer, stats, time.Since(start))
 		if err != nil {
-			log.Println("Error: cannot process file segment: ", err)
-			continue
+			r.segmentFailed(ctx, fileSegmentPointer, err)
 		}
-		r.heapsChan <- h
 	}
-	wg.Done()
+	r.emitHeap(ctx, c)
 }
 
-func validateRankerParams(nWorkers, topK int) error {
+// nextSegment waits for the next segment, false is returned once the input channel is closed,
+// the run is stopped or the worker is retired by shrinking the pool; idle workers are retired right away,
+// busy ones - once they finish their current segments
+func (r *Ranker) nextSegment(ctx context.Context, quit <-chan struct{}) (io.FileSegmentPointer, bool) {
+	select {
+	case <-quit:
+		return io.FileSegmentPointer{}, false
+	case <-ctx.Done():
+		// the emitter may be blocked reading the input, so workers don't wait for it to close the channel
+		return io.FileSegmentPointer{}, false
+	default:
+	}
+	select {
+	case <-quit:
+		return io.FileSegmentPointer{}, false
+	case <-ctx.Done():
+		return io.FileSegmentPointer{}, false
+	case fileSegmentPointer, ok := <-r.inputChan:
+		return fileSegmentPointer, ok
+	}
+}
+
+// segmentDone counts the segment processed by the worker, successfully or not,
+// along with the time the worker spent on it
+func (r *Ranker) segmentDone(fileSegment io.FileSegmentPointer, stats *Stats, busy time.Duration) {
+	atomic.AddInt64(&r.progress.bytesDone, fileSegment.Len)
+	atomic.AddInt64(&r.progress.segmentsDone, 1)
+	stats.Segments++
+	stats.BytesRead += fileSegment.Len
+	stats.WorkerBusy[0] += busy
+}
+
+// stopWorker removes the exiting worker from the running ones, unless it's already retired
+func (r *Ranker) stopWorker(quit chan struct{}) {
+	r.config.Lock()
+	defer r.config.Unlock()
+	for i, q := range r.quits {
+		if q == quit {
+			r.quits = append(r.quits[:i], r.quits[i+1:]...)
+			return
+		}
+	}
+}
+
+// startWorkers starts or retires workers until their number reaches the configured one,
+// it should be called with the config lock held
+func (r *Ranker) startWorkers() {
+	for len(r.quits) < r.config.nWorkers {
+		quit := make(chan struct{})
+		r.quits = append(r.quits, quit)
+		r.workers.Add(1)
+		r.spawn(func() { r.worker(r.workersCtx, quit) })
+	}
+	for len(r.quits) > r.config.nWorkers {
+		close(r.quits[len(r.quits)-1])
+		r.quits = r.quits[:len(r.quits)-1]
+	}
+}
+
+// SetWorkers changes number of workers while the ranker runs: new workers are started right away,
+// idle extra workers exit right away too, while busy ones - once they finish their current segments;
+// the number of workers is limited by MaxWorkers, the warning is returned (and kept in stats) if it's decreased
+func (r *Ranker) SetWorkers(nWorkers int) (string, error) {
+	if nWorkers <= 0 {
+		return "", fmt.Errorf("error: `nWorkers` should be a non-zero positive number")
+	}
+	nWorkers, warning := clampWorkers(nWorkers)
+	r.config.Lock()
+	defer r.config.Unlock()
+	if r.workersDone || len(r.quits) == 0 {
+		return warning, fmt.Errorf("error: workers are finished already")
+	}
+	if warning != "" {
+		r.statsMu.Lock()
+		r.stats.Warnings = append(r.stats.Warnings, warning)
+		r.statsMu.Unlock()
+	}
+	r.config.nWorkers = nWorkers
+	r.startWorkers()
+	return warning, nil
+}
+
+// SetTopK changes number of ranked records while the ranker runs: workers resize their heaps
+// before the next segments; records dropped before the change are not recovered,
+// so increasing k takes full effect only if it's done before segments are emitted
+func (r *Ranker) SetTopK(topK int) error {
 	if topK < 1 {
 		return fmt.Errorf("error: `topK` should be >= 1")
 	}
+	r.config.Lock()
+	defer r.config.Unlock()
+	r.config.topK = topK
+	r.bound.reset()
+	return nil
+}
+
+func (r *Ranker) emitHeap(ctx context.Context, c *collector) {
+	select {
+	case r.heapsChan <- c:
+	case <-ctx.Done():
+	}
+}
+
+// aggregateWorker keeps partial aggregates across all segments it handles
+// and emits them once the input channel is closed or the worker is retired
+func (r *Ranker) aggregateWorker(ctx context.Context, quit chan struct{}, stats *Stats) {
+	groups := newGroupTable(r.config.maxGroups, r.config.values)
+	for {
+		fileSegmentPointer, ok := r.nextSegment(ctx, quit)
+		if !ok || ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		err := r.aggregateSegmentWithRetries(ctx, fileSegmentPointer, groups, stats)
+		r.segmentDone(fileSegmentPointer, stats, time.Since(start))
+		if err != nil {
+			r.segmentFailed(ctx, fileSegmentPointer, err)
+		}
+	}
+	select {
+	case r.groupsChan <- groups:
+	case <-ctx.Done():
+		groups.cleanup()
+	}
+}
+
+// aggregateSegmentWithRetries adds records of the segment to the worker's partial aggregates,
+// records of the failed attempts are dropped
+func (r *Ranker) aggregateSegmentWithRetries(ctx context.Context, fileSegmentPointer io.FileSegmentPointer, groups *groupTable, stats *Stats) error {
+	if r.config.retries == 0 {
+		return r.aggregateSegment(ctx, fileSegmentPointer, groups, stats)
+	}
+	return r.withRetries(ctx, func() error {
+		// segment is aggregated separately, so records of the failed attempt are dropped
+		segmentGroups := newGroupTable(r.config.maxGroups, r.config.values)
+		defer segmentGroups.cleanup()
+		segmentStats := newStats()
+		err := r.aggregateSegment(ctx, fileSegmentPointer, segmentGroups, segmentStats)
+		if err == nil {
+			err = groups.absorb(segmentGroups)
+		}
+		if err != nil {
+			return err
+		}
+		stats.merge(segmentStats)
+		return nil
+	})
+}
+
+// withRetries calls `fn` until it succeeds, but no more than `retries` times after the first attempt;
+// cancellation and fatal errors are never retried
+func (r *Ranker) withRetries(ctx context.Context, fn func() error) error {
+	err := fn()
+	for attempt := 0; attempt < r.config.retries && err != nil; attempt++ {
+		if ctx.Err() != nil || isFatal(err) {
+			return err
+		}
+		err = fn()
+	}
+	return err
+}
+
+// isFatal checks whether the error stops the whole run instead of failing the single segment:
+// the malformed lines limit is exceeded, or the worker's aggregates overflowed, so they are broken anyway
+func isFatal(err error) bool {
+	return errors.Is(err, ErrTooManyMalformed) || errors.Is(err, ErrOverflow)
+}
+
+// segmentFailed keeps the error occurred while processing the segment,
+// so it's returned in the end instead of silently dropping records of the segment
+func (r *Ranker) segmentFailed(ctx context.Context, fileSegment io.FileSegmentPointer, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if isFatal(err) {
+		r.fail(err)
+		return
+	}
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	r.failedSegments = append(r.failedSegments, SegmentError{
+		Path:   fileSegment.Fpath,
+		Source: fileSegment.Source,
+		Start:  fileSegment.Start,
+		Len:    fileSegment.Len,
+		Err:    err,
+	})
+}
+
+// validateRankerParams checks options, the number of workers is limited by MaxWorkers,
+// which is reported by the returned warnings
+func validateRankerParams(opts *Options) ([]string, error) {
+	nWorkers, topK := opts.NWorkers, opts.TopK
+	if topK < 1 {
+		return nil, fmt.Errorf("error: `topK` should be >= 1")
+	}
 	if nWorkers <= 0 {
-		return fmt.Errorf("error: `nWorkers` should be a non-zero positive number")
+		return nil, fmt.Errorf("error: `nWorkers` should be a non-zero positive number")
 	}
-	if nWorkers > 1023 {
-		nWorkers = 1023
-		log.Printf("info: number of workers decreased from %v to 1023, since 1024 is a soft limit (for Linux)\n", nWorkers)
+	if opts.BufSize <= 0 {
+		return nil, fmt.Errorf("error: `bufSize` should be a non-zero positive number")
 	}
-	return nil
+	if _, ok := aggregateNames[opts.Aggregate]; !ok {
+		return nil, fmt.Errorf("error: unknown aggregate %v", opts.Aggregate)
+	}
+	if opts.MaxGroups < 0 {
+		return nil, fmt.Errorf("error: `maxGroups` should be a non-negative number")
+	}
+	if opts.Order != OrderDesc && opts.Order != OrderAsc {
+		return nil, fmt.Errorf("error: unknown order %v", opts.Order)
+	}
+	if opts.TieBreak < TieBreakFirst || opts.TieBreak > TieBreakURL {
+		return nil, fmt.Errorf("error: unknown tie-break %v", opts.TieBreak)
+	}
+	if err := opts.Values.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Malformed < MalformedCount || opts.Malformed > MalformedReject {
+		return nil, fmt.Errorf("error: unknown malformed lines policy %v", opts.Malformed)
+	}
+	if opts.MaxLineLen < 0 {
+		return nil, fmt.Errorf("error: `maxLineLen` should be a non-negative number")
+	}
+	if opts.Retries < 0 {
+		return nil, fmt.Errorf("error: `retries` should be a non-negative number")
+	}
+	if opts.MaxMalformed < 0 {
+		return nil, fmt.Errorf("error: `maxMalformed` should be a non-negative number")
+	}
+	if opts.Malformed == MalformedReject && opts.RejectsPath == "" {
+		return nil, fmt.Errorf("error: rejects path should be set to write malformed lines")
+	}
+	if opts.Delimiter != nil {
+		if err := io.ValidateDelimiter(opts.Delimiter); err != nil {
+			return nil, err
+		}
+	}
+	var warnings []string
+	if n, warning := clampWorkers(nWorkers); warning != "" {
+		opts.NWorkers = n
+		warnings = append(warnings, warning)
+	}
+	return warnings, nil
+}
+
+// NewRanker creates new instance of the ranker, adjustments of the options are returned as warnings
+// (they're kept in stats as well); workers stop processing segments as soon as the context is cancelled
+func NewRanker(ctx context.Context, opts Options) (*Ranker, []string, error) {
+	r, err := newRanker(ctx, opts, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, append([]string{}, r.stats.Warnings...), nil
 }
 
-// NewRanker creates new instance of the ranker
-func NewRanker(nWorkers, topK int) (*Ranker, error) {
-	err := validateRankerParams(nWorkers, topK)
+// newRanker creates the ranker which reuses goroutines and buffers of the pool, if it's set
+func newRanker(ctx context.Context, opts Options, pool *Pool) (*Ranker, error) {
+	warnings, err := validateRankerParams(&opts)
 	if err != nil {
 		return nil, err
 	}
+	if opts.Parser == nil {
+		opts.Parser = record.DefaultParser{Values: opts.Values}
+	}
+	if opts.Delimiter == nil {
+		opts.Delimiter = io.DefaultDelimiter
+	}
+	var rejects *rejectsWriter
+	if opts.Malformed == MalformedReject {
+		rejects, err = newRejectsWriter(opts.RejectsPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rankValues := opts.Values
+	if opts.Aggregate == AggregateMean {
+		// means of integers and decimals are ranked by their unrounded values kept as floats
+		rankValues.Type = record.ValueFloat
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	r := &Ranker{
-		inputChan: make(chan io.FileSegmentPointer),
-		heapsChan: make(chan *heap.InvertedBoundedHeap[record.Record]),
+		inputChan:  make(chan io.FileSegmentPointer),
+		emitDone:   make(chan struct{}),
+		heapsChan:  make(chan *collector),
+		groupsChan: make(chan *groupTable),
 		config: rankerConfig{
-			topK:     topK,
-			nWorkers: nWorkers,
+			topK:             opts.TopK,
+			nWorkers:         opts.NWorkers,
+			aggregate:        opts.Aggregate,
+			maxGroups:        opts.MaxGroups,
+			order:            opts.Order,
+			tieBreak:         opts.TieBreak,
+			includeTies:      opts.IncludeTies,
+			values:           opts.Values,
+			parser:           opts.Parser,
+			malformed:        opts.Malformed,
+			maxMalformed:     opts.MaxMalformed,
+			retries:          opts.Retries,
+			maxLineLen:       opts.MaxLineLen,
+			validateSegments: opts.ValidateSegments,
+			delimiter:        opts.Delimiter,
+			mmap:             opts.Mmap,
 		},
+		comparator: newComparator(opts.Order, opts.TieBreak, rankValues),
+		worseValue: newValueComparator(opts.Order, rankValues),
+		rejects:    rejects,
+		stats:      newStats(),
+		failed:     make(chan struct{}),
+		cancel:     cancel,
+		spawn:      func(f func()) { go f() },
+		readers:    &lineReaders{},
+		started:    time.Now(),
+	}
+	if pool != nil {
+		r.spawn = pool.spawn
+		r.readers = &pool.readers
+	}
+	r.stats.Warnings = warnings
+	r.workersCtx = ctx
+	r.config.Lock()
+	r.startWorkers()
+	r.config.Unlock()
+	var progressDone chan struct{}
+	workersDone := make(chan struct{})
+	if opts.OnProgress != nil {
+		interval := opts.ProgressInterval
+		if interval <= 0 {
+			interval = DefaultProgressInterval
+		}
+		progressDone = make(chan struct{})
+		go func() {
+			defer close(progressDone)
+			r.reportProgress(opts.OnProgress, interval, workersDone)
+		}()
 	}
 	go func() {
-		wg := &sync.WaitGroup{}
-		for i := 0; i < nWorkers; i++ {
-			wg.Add(1)
-			go r.worker(wg)
+		r.workers.Wait()
+		r.workersFinished = time.Now()
+		close(workersDone)
+		if progressDone != nil {
+			// the final progress is reported before the result is returned
+			<-progressDone
+		}
+		r.config.Lock()
+		r.workersDone = true
+		r.config.Unlock()
+		select {
+		case <-r.emitDone:
+			r.unmap()
+		default:
+			// the run is stopped while the emitter still splits inputs, they're unmapped once it exits
+			go func() {
+				<-r.emitDone
+				r.unmap()
+			}()
 		}
-		wg.Wait()
+		if r.rejects != nil {
+			if err := r.rejects.close(); err != nil {
+				r.fail(fmt.Errorf("error: cannot write rejected lines: %w", err))
+			}
+		}
+		r.cancel()
 		close(r.heapsChan)
+		close(r.groupsChan)
 	}()
 	return r, nil
 }
 
-// GetRankedList merges heaps produced by mappers and
-// outputs slice of topk ranked urls
-func (r *Ranker) GetRankedList() []string {
-	topK := r.config.getTopK()
-	finalHeap := heap.NewHeap(comparator, topK, nil)
-	for h := range r.heapsChan {
-		finalHeap.Merge(h)
+func (r *Ranker) unmap() {
+	for _, mapped := range r.mapped {
+		mapped.Close()
 	}
-	if finalHeap.Len() == 0 {
-		return []string{}
+}
+
+// mergeGroups merges partial aggregates produced by workers
+// and collects the best records from the aggregated values
+func (r *Ranker) mergeGroups() (*collector, error) {
+	finalGroups := newGroupTable(r.config.maxGroups, r.config.values)
+	defer finalGroups.cleanup()
+	var err error
+	for groups := range r.groupsChan {
+		if err == nil {
+			err = finalGroups.absorb(groups)
+		}
+		// runs are either moved to the final table or should be dropped
+		groups.cleanup()
 	}
-	if finalHeap.Len() < topK {
-		topK = finalHeap.Len()
+	if err != nil {
+		return nil, err
 	}
-	result := make([]string, topK)
-	// invert an order of elements, since we're maintaining min heap
-	// but we need highest values first in result
-	for i := topK - 1; i >= 0; i-- {
-		v := finalHeap.Pop()
-		result[i] = v.Url
+	final := r.newCollector()
+	err = finalGroups.each(func(url string, g group) error {
+		source, offset := g.source, g.offset
+		if r.config.tieBreak == TieBreakLast {
+			source, offset = g.lastSource, g.lastOffset
+		}
+		rec, err := g.value(r.config.aggregate, r.config.values)
+		if err != nil {
+			return fmt.Errorf("%w: url `%v`", err, url)
+		}
+		rec.Url, rec.Offset, rec.Source = url, offset, source
+		final.push(rec)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return result
+	return final, nil
+}
+
+// mergeHeaps merges heaps produced by workers: heaps are merged by several mergers in parallel
+// as they arrive, then results of mergers are reduced pairwise
+func (r *Ranker) mergeHeaps() *collector {
+	mergers := make([]*collector, r.config.getWorkers())
+	var wg sync.WaitGroup
+	for i := range mergers {
+		mergers[i] = r.newCollector()
+		wg.Add(1)
+		go func(merger *collector) {
+			defer wg.Done()
+			for c := range r.heapsChan {
+				merger.merge(c)
+			}
+		}(mergers[i])
+	}
+	wg.Wait()
+	return mergeCollectors(mergers)
 }
 
-// EmitFileSegments starts parsing the file and emits found segments
-// one by one to the input channel, then closes it to stop the workers
-func (r *Ranker) EmitFileSegments(fpath string, bufSize int, segmentSize int64) error {
-	segmentsChan, err := io.GetFileSegments(fpath, bufSize, segmentSize, '\n')
+// GetRankedRecords works the same way as RankedRecords, but errors are only logged
+func (r *Ranker) GetRankedRecords() []record.Record {
+	records, err := r.RankedRecords()
 	if err != nil {
-		return err
+		log.Println("Error: ranked records are incomplete: ", err)
 	}
+	return records
+}
+
+// RankedRecords waits for the workers, merges heaps produced by them and
+// outputs slice of topk records in rank order: highest values first
+// or lowest values first for the ascending order; records with equal values
+// are ordered according to the configured tie-break;
+// if the run is stopped, some segments failed or inputs couldn't be split,
+// the error is returned along with the records ranked so far
+func (r *Ranker) RankedRecords() ([]record.Record, error) {
+	var final *collector
+	if r.config.aggregate != AggregateNone {
+		var err error
+		final, err = r.mergeGroups()
+		if err != nil {
+			return []record.Record{}, err
+		}
+	} else {
+		final = r.mergeHeaps()
+		// k could be decreased while the workers run
+		final.resize(r.config.getTopK())
+	}
+	// workers are finished at this point
+	r.statsMu.Lock()
+	r.stats.MergeTime = time.Since(r.workersFinished)
+	r.stats.WallTime = time.Since(r.started)
+	r.statsMu.Unlock()
+	if r.err != nil {
+		return final.result(), r.err
+	}
+	if len(r.failedSegments) > 0 {
+		return final.result(), newSegmentsError(r.failedSegments)
+	}
+	select {
+	case <-r.emitDone:
+		return final.result(), r.emitErr
+	default:
+		// workers are stopped before the emitter exits only if the run is cancelled
+		return final.result(), r.workersCtx.Err()
+	}
+}
+
+// GetRankedList works the same way as RankedList, but errors are only logged
+func (r *Ranker) GetRankedList() []string {
+	return urls(r.GetRankedRecords())
+}
+
+// RankedList outputs slice of topk ranked urls, errors are reported the same way as by RankedRecords
+func (r *Ranker) RankedList() ([]string, error) {
+	records, err := r.RankedRecords()
+	return urls(records), err
+}
+
+func urls(records []record.Record) []string {
+	result := make([]string, len(records))
+	for i, rec := range records {
+		result[i] = rec.Url
+	}
+	return result
+}
+
+// EmitFileSegments splits files one by one and emits found segments
+// to the input channel, then closes it to stop the workers;
+// `-` path means reading from stdin; compressed inputs are detected by magic bytes;
+// emission stops early if the context is cancelled
+func (r *Ranker) EmitFileSegments(ctx context.Context, fpaths []string, bufSize int, segmentSize int64) error {
+	r.parsers = make([]record.Parser, len(fpaths))
+	// total size is known only if all inputs are split into segments of the files
+	var totalBytes int64 = 0
+	for _, fpath := range fpaths {
+		if fpath == io.StdinPath {
+			totalBytes = -1
+			continue
+		}
+		compression, err := io.FileCompression(fpath)
+		if err == nil {
+			err = compression.Validate()
+		}
+		if err != nil {
+			close(r.emitDone)
+			close(r.inputChan)
+			return err
+		}
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			close(r.emitDone)
+			close(r.inputChan)
+			return err
+		}
+		splittable := compression == io.CompressionNone || (compression == io.CompressionBGZF && len(r.config.delimiter) == 1)
+		if !splittable {
+			totalBytes = -1
+		} else if totalBytes >= 0 {
+			totalBytes += fi.Size()
+		}
+	}
+	if totalBytes > 0 {
+		atomic.StoreInt64(&r.progress.totalBytes, totalBytes)
+	}
+	// emission stops as soon as the workers fail as well
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-r.failed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 	go func() {
-		for segment := range segmentsChan {
-			r.inputChan <- segment
+		defer cancel()
+		defer close(r.inputChan)
+		// emitter is done before the channel is closed, so emitDone is closed once the workers finish normally
+		defer close(r.emitDone)
+		for source, fpath := range fpaths {
+			if ctx.Err() != nil {
+				return
+			}
+			err := r.emitInput(ctx, source, fpath, bufSize, segmentSize)
+			if err != nil {
+				r.emitErr = err
+				return
+			}
 		}
-		close(r.inputChan)
 	}()
 	return nil
 }
 
+// emitInput emits segments of a single input: plain and BGZF files are split into segments
+// which workers read independently, while stdin and other compressed files are read sequentially;
+// BGZF files are read sequentially as well if lines are split by the multi-byte delimiter
+func (r *Ranker) emitInput(ctx context.Context, source int, fpath string, bufSize int, segmentSize int64) error {
+	if fpath == io.StdinPath {
+		return r.emitStream(ctx, source, fpath, bufio.NewReader(os.Stdin), bufSize, segmentSize)
+	}
+	compression, err := io.FileCompression(fpath)
+	if err != nil {
+		return err
+	}
+	if compression == io.CompressionBGZF && len(r.config.delimiter) > 1 {
+		compression = io.CompressionGzip
+	}
+	if compression == io.CompressionNone || compression == io.CompressionBGZF {
+		err = r.bindParser(source, func() (string, error) {
+			return io.ReadHeader(fpath, bufSize, r.config.delimiter)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	switch compression {
+	case io.CompressionNone:
+		segments, err := r.fileSegments(ctx, fpath, bufSize, segmentSize)
+		if err != nil {
+			return err
+		}
+		emitted := r.forwardSegments(ctx, source, segments.C)
+		if err := segments.Err(); err != nil || !r.config.validateSegments || ctx.Err() != nil {
+			return err
+		}
+		return io.ValidateSegments(fpath, emitted, r.config.delimiter)
+	case io.CompressionBGZF:
+		segments, err := io.GetBGZFSegments(ctx, fpath, bufSize, segmentSize)
+		if err != nil {
+			return err
+		}
+		r.forwardSegments(ctx, source, segments.C)
+		return segments.Err()
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.emitStream(ctx, source, fpath, bufio.NewReader(f), bufSize, segmentSize)
+}
+
+// fileSegments splits the plain file into segments, which are slices of the mapped file in the mmap mode
+func (r *Ranker) fileSegments(ctx context.Context, fpath string, bufSize int, segmentSize int64) (*io.Segments, error) {
+	if !r.config.mmap {
+		return io.GetFileSegments(ctx, fpath, bufSize, segmentSize, r.config.delimiter)
+	}
+	mapped, err := io.OpenMapped(fpath)
+	if err != nil {
+		return nil, err
+	}
+	r.mapped = append(r.mapped, mapped)
+	return io.GetMappedSegments(ctx, mapped, bufSize, segmentSize, r.config.delimiter), nil
+}
+
+// emitStream decompresses the stream, if it's compressed, and emits it as in-memory segments
+func (r *Ranker) emitStream(ctx context.Context, source int, name string, input *bufio.Reader, bufSize int, segmentSize int64) error {
+	reader, err := io.NewDecompressingReader(input, io.PeekCompression(input))
+	if err != nil {
+		return err
+	}
+	if _, ok := r.config.parser.(record.HeaderParser); ok {
+		buffered := bufio.NewReaderSize(reader, bufSize)
+		reader = buffered
+		err = r.bindParser(source, func() (string, error) {
+			return io.PeekLine(buffered, r.config.delimiter)
+		})
+	} else {
+		err = r.bindParser(source, nil)
+	}
+	if err != nil {
+		return err
+	}
+	segments := io.GetStreamSegments(ctx, reader, name, bufSize, segmentSize, r.config.maxLineLen, r.config.delimiter)
+	r.forwardSegments(ctx, source, segments.C)
+	return segments.Err()
+}
+
+// bindParser sets the parser of the input, header parsers are bound to the line returned by `header`
+func (r *Ranker) bindParser(source int, header func() (string, error)) error {
+	hp, ok := r.config.parser.(record.HeaderParser)
+	if !ok {
+		r.parsers[source] = r.config.parser
+		return nil
+	}
+	line, err := header()
+	if err != nil {
+		return fmt.Errorf("error: cannot read header: %w", err)
+	}
+	parser, err := hp.WithHeader(line)
+	if err != nil {
+		return err
+	}
+	r.parsers[source] = parser
+	return nil
+}
+
+// forwardSegments passes segments to the workers, emitted segments are returned in the validation mode
+func (r *Ranker) forwardSegments(ctx context.Context, source int, segmentsChan chan io.FileSegmentPointer) []io.FileSegmentPointer {
+	var emitted []io.FileSegmentPointer
+	for segment := range segmentsChan {
+		if r.config.validateSegments {
+			emitted = append(emitted, segment)
+		}
+		segment.Source = source
+		// segment is counted before it's received, so it's never done before emitted
+		atomic.AddInt64(&r.progress.segmentsEmitted, 1)
+		select {
+		case r.inputChan <- segment:
+		case <-ctx.Done():
+			atomic.AddInt64(&r.progress.segmentsEmitted, -1)
+		}
+	}
+	return emitted
+}
+
 // ProcessFile reads file, splits it in segments and sends segments to ranker workers;
 // Then it waits for the final aggregated result and returns it;
 // if `segmentSize` is zero - file will not be splitted in chunks
 func ProcessFile(fpath string, bufSize, nWorkers, topK int, segmentSize int64) ([]string, error) {
-	if int64(bufSize) > segmentSize && segmentSize != 0 {
-		return nil, errors.New("error: segment size should be larger than buffer size")
-	}
-	r, err := NewRanker(nWorkers, topK)
+	return ProcessFileContext(context.Background(), fpath, bufSize, nWorkers, topK, segmentSize)
+}
+
+// ProcessFileContext works the same way as ProcessFile, but stops reading the file
+// as soon as the context is cancelled; in that case it waits for all workers to exit
+// and returns the context error
+func ProcessFileContext(ctx context.Context, fpath string, bufSize, nWorkers, topK int, segmentSize int64) ([]string, error) {
+	records, err := ProcessFileRecords(ctx, fpath, Options{
+		BufSize:     bufSize,
+		NWorkers:    nWorkers,
+		TopK:        topK,
+		SegmentSize: segmentSize,
+	})
 	if err != nil {
 		return nil, err
 	}
-	err = r.EmitFileSegments(fpath, bufSize, segmentSize)
+	return urls(records), nil
+}
+
+// ProcessFileRecords works the same way as ProcessFileContext, but returns
+// ranked records with their values and offsets instead of bare urls
+func ProcessFileRecords(ctx context.Context, fpath string, opts Options) ([]record.Record, error) {
+	return ProcessFiles(ctx, []string{fpath}, opts)
+}
+
+// ProcessFiles ranks records of all the provided files together, as if they were a single file;
+// `-` path means reading from stdin, which is split in the in-memory segments
+func ProcessFiles(ctx context.Context, fpaths []string, opts Options) ([]record.Record, error) {
+	records, _, err := ProcessFilesStats(ctx, fpaths, opts)
+	return records, err
+}
+
+// ProcessFilesStats works the same way as ProcessFiles, but also returns statistics of the run,
+// which are available even if processing failed after the workers started
+func ProcessFilesStats(ctx context.Context, fpaths []string, opts Options) ([]record.Record, *Stats, error) {
+	return processFiles(ctx, fpaths, opts, nil)
+}
+
+// processFiles runs the ranker for the files, goroutines and buffers of the pool are reused if it's set
+func processFiles(ctx context.Context, fpaths []string, opts Options, pool *Pool) ([]record.Record, *Stats, error) {
+	if int64(opts.BufSize) > opts.SegmentSize && opts.SegmentSize != 0 {
+		return nil, nil, errors.New("error: segment size should be larger than buffer size")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	r, err := newRanker(ctx, opts, pool)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	err = r.EmitFileSegments(ctx, fpaths, opts.BufSize, opts.SegmentSize)
+	if err != nil {
+		// input channel is already closed, so just wait for workers to exit
+		r.RankedRecords()
+		return nil, r.Stats(), err
+	}
+	rank, err := r.RankedRecords()
+	if r.err != nil {
+		return nil, r.Stats(), r.err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, r.Stats(), ctxErr
+	}
+	if err != nil {
+		return nil, r.Stats(), err
 	}
-	rank := r.GetRankedList()
-	return rank, nil
+	return rank, r.Stats(), nil
 }
@@ -1,9 +1,24 @@
 package ranker
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/io"
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+	"github.com/gasparian/clickhouse-test-file-reader/internal/testutil"
 )
 
 const (
@@ -55,6 +70,14 @@ http://api.tech.com/item/125345  111
 			}
 		}
 	})
+
+	t.Run("InvalidBufSize", func(t *testing.T) {
+		for _, size := range []int{0, -5} {
+			if _, err := ProcessFile(fpath, size, 1, topK, 4); err == nil {
+				t.Fatalf("Expected error for buffer size %v", size)
+			}
+		}
+	})
 }
 
 func TestRankerShortSeq(t *testing.T) {
@@ -96,3 +119,1404 @@ func TestRankerEmptyInput(t *testing.T) {
 		t.Fatal("Output should be empty slice")
 	}
 }
+
+func TestProcessFileContextCanceled(t *testing.T) {
+	fpath := "/tmp/clickhouse-file-reader-test-ranker-canceled"
+	defer os.RemoveAll(fpath)
+	data := []byte(`
+http://api.tech.com/item/121345  9
+http://api.tech.com/item/122345  350
+http://api.tech.com/item/123345  25
+http://api.tech.com/item/124345  231
+http://api.tech.com/item/125345  111
+
+`)
+	err := os.WriteFile(fpath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := ProcessFileContext(ctx, fpath, bufSize, 4, topK, 64)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected `%v` error, but got `%v`", context.Canceled, err)
+	}
+	if res != nil {
+		t.Fatalf("Result should be empty, but got %v", res)
+	}
+}
+
+func TestProcessStdinCanceled(t *testing.T) {
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	origStdin := os.Stdin
+	os.Stdin = stdin
+	// the writer is kept open, so the emitter stays blocked reading stdin after the first segment
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(w, "http://api.tech.com/item/%v  %v\n", i, i)
+	}
+	emitted := make(chan struct{})
+	var once sync.Once
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ProcessFiles(ctx, []string{io.StdinPath}, Options{
+			BufSize:          bufSize,
+			NWorkers:         2,
+			TopK:             topK,
+			SegmentSize:      64,
+			ProgressInterval: time.Millisecond,
+			OnProgress: func(p Progress) {
+				if p.SegmentsEmitted > 0 {
+					once.Do(func() { close(emitted) })
+				}
+			},
+		})
+		done <- err
+	}()
+	<-emitted
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected `%v` error, but got `%v`", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the run to stop while stdin is still open")
+	}
+	w.Close()
+	os.Stdin = origStdin
+}
+
+func TestProcessFileRecords(t *testing.T) {
+	fpath := "/tmp/clickhouse-file-reader-test-ranker-records"
+	defer os.RemoveAll(fpath)
+	data := []byte(`
+http://api.tech.com/item/121345  9
+http://api.tech.com/item/122345  350
+http://api.tech.com/item/123345  25
+http://api.tech.com/item/124345  231
+http://api.tech.com/item/125345  111
+
+`)
+	err := os.WriteFile(fpath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := []record.Record{
+		{Url: "http://api.tech.com/item/122345", Value: 350},
+		{Url: "http://api.tech.com/item/124345", Value: 231},
+	}
+	for _, nWorkers := range []int{1, 4} {
+		res, err := ProcessFileRecords(context.Background(), fpath, Options{
+			BufSize:     bufSize,
+			NWorkers:    nWorkers,
+			TopK:        topK,
+			SegmentSize: 64,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(gt) {
+			t.Fatalf("Expected %v records, but got %v", len(gt), len(res))
+		}
+		for i, r := range res {
+			if !record.Equal(r, gt[i]) {
+				t.Fatalf("Expected `%v` but got `%v`", gt[i], r)
+			}
+			if !strings.HasPrefix(string(data[r.Offset:]), r.Url) {
+				t.Fatalf("Offset %v does not point to the `%v` line", r.Offset, r.Url)
+			}
+		}
+	}
+}
+
+func TestProcessFileAggregate(t *testing.T) {
+	fpath := "/tmp/clickhouse-file-reader-test-ranker-aggregate"
+	defer os.RemoveAll(fpath)
+	data := []byte(`
+http://api.tech.com/item/1  9
+http://api.tech.com/item/2  350
+http://api.tech.com/item/1  25
+http://api.tech.com/item/3  231
+http://api.tech.com/item/1  111
+http://api.tech.com/item/3  1
+http://api.tech.com/item/1  5
+
+`)
+	err := os.WriteFile(fpath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		aggregate Aggregate
+		gt        []record.Record
+	}{
+		{AggregateSum, []record.Record{
+			{Url: "http://api.tech.com/item/2", Value: 350},
+			{Url: "http://api.tech.com/item/3", Value: 232},
+		}},
+		{AggregateCount, []record.Record{
+			{Url: "http://api.tech.com/item/1", Value: 4},
+			{Url: "http://api.tech.com/item/3", Value: 2},
+		}},
+		{AggregateMax, []record.Record{
+			{Url: "http://api.tech.com/item/2", Value: 350},
+			{Url: "http://api.tech.com/item/3", Value: 231},
+		}},
+		{AggregateMin, []record.Record{
+			{Url: "http://api.tech.com/item/2", Value: 350},
+			{Url: "http://api.tech.com/item/1", Value: 5},
+		}},
+		{AggregateMean, []record.Record{
+			{Url: "http://api.tech.com/item/2", Value: 350, Float: 350},
+			{Url: "http://api.tech.com/item/3", Value: 116, Float: 116},
+		}},
+	}
+	for _, c := range cases {
+		for _, maxGroups := range []int{0, 1} {
+			res, err := ProcessFileRecords(context.Background(), fpath, Options{
+				BufSize:     bufSize,
+				NWorkers:    3,
+				TopK:        topK,
+				SegmentSize: 64,
+				Aggregate:   c.aggregate,
+				MaxGroups:   maxGroups,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) != len(c.gt) {
+				t.Fatalf("%v: expected %v records, but got %v", c.aggregate, len(c.gt), len(res))
+			}
+			for i, r := range res {
+				if !record.Equal(r, c.gt[i]) {
+					t.Fatalf("%v: expected `%v` but got `%v`", c.aggregate, c.gt[i], r)
+				}
+			}
+		}
+	}
+}
+
+func TestProcessFileAggregateMean(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	data := []byte(`http://b  1
+http://a  1
+http://a  2
+http://d  -1
+http://c  -1
+http://c  -2
+`)
+	if err := os.WriteFile(fpath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// means are ranked by their unrounded values, and reported rounded half away from zero
+	gt := []record.Record{
+		{Url: "http://a", Value: 2, Float: 1.5},
+		{Url: "http://b", Value: 1, Float: 1},
+		{Url: "http://d", Value: -1, Float: -1},
+		{Url: "http://c", Value: -2, Float: -1.5},
+	}
+	for _, tieBreak := range []TieBreak{TieBreakFirst, TieBreakLast, TieBreakURL} {
+		for _, order := range []Order{OrderDesc, OrderAsc} {
+			res, err := ProcessFileRecords(context.Background(), fpath, Options{
+				BufSize:   bufSize,
+				NWorkers:  2,
+				TopK:      len(gt),
+				Aggregate: AggregateMean,
+				Order:     order,
+				TieBreak:  tieBreak,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, r := range res {
+				expected := gt[i]
+				if order == OrderAsc {
+					expected = gt[len(gt)-1-i]
+				}
+				if r.Url != expected.Url || !record.SameValue(r, expected) {
+					t.Fatalf("%v, %v: expected `%v` but got `%v`", tieBreak, order, expected, r)
+				}
+			}
+		}
+	}
+}
+
+func TestProcessFileBottomK(t *testing.T) {
+	fpath := "/tmp/clickhouse-file-reader-test-ranker-bottom"
+	defer os.RemoveAll(fpath)
+	data := []byte(`
+http://api.tech.com/item/121345  9
+http://api.tech.com/item/122345  350
+http://api.tech.com/item/123345  25
+http://api.tech.com/item/124345  231
+http://api.tech.com/item/125345  111
+
+`)
+	err := os.WriteFile(fpath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := []record.Record{
+		{Url: "http://api.tech.com/item/121345", Value: 9},
+		{Url: "http://api.tech.com/item/123345", Value: 25},
+	}
+	for _, nWorkers := range []int{1, 4} {
+		res, err := ProcessFileRecords(context.Background(), fpath, Options{
+			BufSize:     bufSize,
+			NWorkers:    nWorkers,
+			TopK:        topK,
+			SegmentSize: 64,
+			Order:       OrderAsc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(gt) {
+			t.Fatalf("Expected %v records, but got %v", len(gt), len(res))
+		}
+		for i, r := range res {
+			if !record.Equal(r, gt[i]) {
+				t.Fatalf("Expected `%v` but got `%v`", gt[i], r)
+			}
+		}
+	}
+}
+
+func TestProcessFileTies(t *testing.T) {
+	fpath := "/tmp/clickhouse-file-reader-test-ranker-ties"
+	defer os.RemoveAll(fpath)
+	data := []byte(`
+http://api.tech.com/item/4  10
+http://api.tech.com/item/1  350
+http://api.tech.com/item/3  10
+http://api.tech.com/item/5  1
+http://api.tech.com/item/2  10
+
+`)
+	err := os.WriteFile(fpath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		tieBreak    TieBreak
+		includeTies bool
+		gt          []string
+	}{
+		{TieBreakFirst, false, []string{"http://api.tech.com/item/1", "http://api.tech.com/item/4"}},
+		{TieBreakLast, false, []string{"http://api.tech.com/item/1", "http://api.tech.com/item/2"}},
+		{TieBreakURL, false, []string{"http://api.tech.com/item/1", "http://api.tech.com/item/2"}},
+		{TieBreakURL, true, []string{
+			"http://api.tech.com/item/1",
+			"http://api.tech.com/item/2",
+			"http://api.tech.com/item/3",
+			"http://api.tech.com/item/4",
+		}},
+	}
+	for _, c := range cases {
+		res, err := ProcessFileRecords(context.Background(), fpath, Options{
+			BufSize:     bufSize,
+			NWorkers:    4,
+			TopK:        topK,
+			SegmentSize: 0,
+			TieBreak:    c.tieBreak,
+			IncludeTies: c.includeTies,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(c.gt) {
+			t.Fatalf("%v: expected %v records, but got %v", c.tieBreak, len(c.gt), len(res))
+		}
+		for i, r := range res {
+			if r.Url != c.gt[i] {
+				t.Fatalf("%v: expected `%v` but got `%v`", c.tieBreak, c.gt[i], r.Url)
+			}
+		}
+	}
+}
+
+func TestProcessFiles(t *testing.T) {
+	dir := t.TempDir()
+	inputs := [][]byte{
+		[]byte(`http://api.tech.com/item/1  9
+http://api.tech.com/item/2  350
+`),
+		[]byte(`http://api.tech.com/item/3  25
+http://api.tech.com/item/4  231`),
+		[]byte(`http://api.tech.com/item/5  111
+http://api.tech.com/item/6  300
+`),
+	}
+	fpaths := make([]string, len(inputs)-1)
+	for i := range fpaths {
+		fpaths[i] = filepath.Join(dir, fmt.Sprintf("input-%v", i))
+		err := os.WriteFile(fpaths[i], inputs[i], 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the last input is read from stdin
+	stdinPath := filepath.Join(dir, "stdin")
+	err := os.WriteFile(stdinPath, inputs[len(inputs)-1], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(stdinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	origStdin := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = origStdin }()
+
+	res, err := ProcessFiles(context.Background(), append(fpaths, io.StdinPath), Options{
+		BufSize:     bufSize,
+		NWorkers:    4,
+		TopK:        3,
+		SegmentSize: 0,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := []record.Record{
+		{Url: "http://api.tech.com/item/2", Value: 350, Source: 0},
+		{Url: "http://api.tech.com/item/6", Value: 300, Source: 2},
+		{Url: "http://api.tech.com/item/4", Value: 231, Source: 1},
+	}
+	if len(res) != len(gt) {
+		t.Fatalf("Expected %v records, but got %v", len(gt), len(res))
+	}
+	for i, r := range res {
+		if !record.Equal(r, gt[i]) || r.Source != gt[i].Source {
+			t.Fatalf("Expected `%v` but got `%v`", gt[i], r)
+		}
+		if !strings.HasPrefix(string(inputs[r.Source][r.Offset:]), r.Url) {
+			t.Fatalf("Offset %v does not point to the `%v` line", r.Offset, r.Url)
+		}
+	}
+
+	_, err = ProcessFiles(context.Background(), []string{fpaths[0], filepath.Join(dir, "missing")}, Options{
+		BufSize:  bufSize,
+		NWorkers: 1,
+		TopK:     1,
+	})
+	if err == nil {
+		t.Fatal("Missing input should be reported")
+	}
+}
+
+func TestProcessCompressedFiles(t *testing.T) {
+	data := []byte(`
+http://api.tech.com/item/121345  9
+http://api.tech.com/item/122345  350
+http://api.tech.com/item/123345  25
+http://api.tech.com/item/124345  231
+http://api.tech.com/item/125345  111
+http://api.tech.com/item/126345  300
+
+`)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(data)
+	w.Close()
+	var multiGz bytes.Buffer
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		w := gzip.NewWriter(&multiGz)
+		w.Write(line)
+		w.Close()
+	}
+	dir := t.TempDir()
+	opts := Options{
+		BufSize:     bufSize,
+		NWorkers:    4,
+		TopK:        3,
+		SegmentSize: 64,
+	}
+	plainPath := filepath.Join(dir, "plain")
+	err := os.WriteFile(plainPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt, err := ProcessFileRecords(context.Background(), plainPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := map[string][]byte{
+		"gzip":        gz.Bytes(),
+		"multigzip":   multiGz.Bytes(),
+		"bgzf":        testutil.WriteBGZF(t, data, 16),
+		"bgzf-single": testutil.WriteBGZF(t, data, 1024),
+	}
+	for name, compressed := range inputs {
+		fpath := filepath.Join(dir, name)
+		err := os.WriteFile(fpath, compressed, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ProcessFileRecords(context.Background(), fpath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(gt) {
+			t.Fatalf("%v: expected %v records, but got %v", name, len(gt), len(res))
+		}
+		for i := range res {
+			if res[i] != gt[i] {
+				t.Fatalf("%v: expected `%v`, but got `%v`", name, gt[i], res[i])
+			}
+		}
+	}
+
+	zstdPath := filepath.Join(dir, "zstd")
+	err = os.WriteFile(zstdPath, []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ProcessFileRecords(context.Background(), zstdPath, opts)
+	if !errors.Is(err, io.ErrUnsupportedCompression) {
+		t.Fatalf("Expected `%v`, but got `%v`", io.ErrUnsupportedCompression, err)
+	}
+}
+
+func TestProcessFilesFormats(t *testing.T) {
+	dir := t.TempDir()
+	csvData := []byte(`status,latency,path
+200,9,http://api.tech.com/item/1
+200,350,http://api.tech.com/item/2
+500,25,http://api.tech.com/item/3
+200,231,http://api.tech.com/item/4
+`)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(csvData)
+	w.Close()
+	inputs := map[string][]byte{
+		"csv":    csvData,
+		"csv.gz": gz.Bytes(),
+		"bgzf":   testutil.WriteBGZF(t, csvData, 16),
+	}
+	parser, err := record.NewParser("csv", record.ParserOptions{Key: "path", Value: "latency"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := []record.Record{
+		{Url: "http://api.tech.com/item/2", Value: 350},
+		{Url: "http://api.tech.com/item/4", Value: 231},
+	}
+	for name, data := range inputs {
+		fpath := filepath.Join(dir, name)
+		err := os.WriteFile(fpath, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ProcessFileRecords(context.Background(), fpath, Options{
+			BufSize:  bufSize,
+			NWorkers: 2,
+			TopK:     topK,
+			Parser:   parser,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(gt) {
+			t.Fatalf("%v: expected %v records, but got %v", name, len(gt), len(res))
+		}
+		for i := range res {
+			if !record.Equal(res[i], gt[i]) {
+				t.Fatalf("%v: expected `%v`, but got `%v`", name, gt[i], res[i])
+			}
+		}
+	}
+
+	// header with a numeric value column should not be ranked
+	headerPath := filepath.Join(dir, "header.tsv")
+	err = os.WriteFile(headerPath, []byte("path\t999\n/item/1\t5\n/item/2\t7\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, _ = record.NewParser("tsv", record.ParserOptions{Header: true})
+	res, err := ProcessFileRecords(context.Background(), headerPath, Options{
+		BufSize:  bufSize,
+		NWorkers: 1,
+		TopK:     1,
+		Parser:   parser,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Url != "/item/2" {
+		t.Fatalf("Expected `/item/2` but got %v", res)
+	}
+
+	jsonPath := filepath.Join(dir, "input.jsonl")
+	err = os.WriteFile(jsonPath, []byte(`{"url": "/item/1", "value": 5}
+{"url": "/item/2", "value": 7}
+{"url": "/item/3", "value": 1}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, _ = record.NewParser("jsonl", record.ParserOptions{})
+	res, err = ProcessFileRecords(context.Background(), jsonPath, Options{
+		BufSize:  bufSize,
+		NWorkers: 2,
+		TopK:     topK,
+		Parser:   parser,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Url != "/item/2" || res[1].Url != "/item/1" {
+		t.Fatalf("Expected `/item/2`, `/item/1` but got %v", res)
+	}
+
+	parser, _ = record.NewParser("csv", record.ParserOptions{Key: "url", Value: "value"})
+	_, err = ProcessFileRecords(context.Background(), headerPath, Options{
+		BufSize:  bufSize,
+		NWorkers: 1,
+		TopK:     1,
+		Parser:   parser,
+	})
+	if err == nil {
+		t.Fatal("Missing header columns should be reported")
+	}
+}
+
+func TestProcessFileValues(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	err := os.WriteFile(fpath, []byte(`http://api.tech.com/item/1  0.352
+http://api.tech.com/item/2  NaN
+http://api.tech.com/item/3  1e-3
+http://api.tech.com/item/1  0.35
+http://api.tech.com/item/4  -Inf
+http://api.tech.com/item/5  12
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		opts Options
+		gt   []string
+	}{
+		{Options{TopK: 3, Values: record.ValueFormat{Type: record.ValueFloat}},
+			[]string{"http://api.tech.com/item/5", "http://api.tech.com/item/1", "http://api.tech.com/item/1"}},
+		{Options{TopK: 2, Values: record.ValueFormat{Type: record.ValueFloat, NaN: record.NaNHighest}},
+			[]string{"http://api.tech.com/item/2", "http://api.tech.com/item/5"}},
+		{Options{TopK: 2, Order: OrderAsc, Values: record.ValueFormat{Type: record.ValueFloat, NaN: record.NaNLowest}},
+			[]string{"http://api.tech.com/item/2", "http://api.tech.com/item/4"}},
+		{Options{TopK: 2, Order: OrderAsc, Values: record.ValueFormat{Type: record.ValueDecimal, Scale: 3}},
+			[]string{"http://api.tech.com/item/1", "http://api.tech.com/item/1"}},
+		{Options{TopK: 1, Aggregate: AggregateSum, MaxGroups: 1, Values: record.ValueFormat{Type: record.ValueFloat}},
+			[]string{"http://api.tech.com/item/5"}},
+		{Options{TopK: 2, Aggregate: AggregateCount, Values: record.ValueFormat{Type: record.ValueDecimal, Scale: 3}},
+			[]string{"http://api.tech.com/item/1", "http://api.tech.com/item/5"}},
+	}
+	for i, c := range cases {
+		c.opts.BufSize = bufSize
+		c.opts.NWorkers = 2
+		res, err := ProcessFileRecords(context.Background(), fpath, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(c.gt) {
+			t.Fatalf("Case %v: expected %v records, but got %v", i, len(c.gt), res)
+		}
+		for j := range res {
+			if res[j].Url != c.gt[j] {
+				t.Fatalf("Case %v: expected `%v` but got `%v`", i, c.gt[j], res[j])
+			}
+		}
+	}
+	res, err := ProcessFileRecords(context.Background(), fpath, Options{
+		BufSize:   bufSize,
+		NWorkers:  2,
+		TopK:      1,
+		Aggregate: AggregateMean,
+		Values:    record.ValueFormat{Type: record.ValueDecimal, Scale: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].Value != 12000 {
+		t.Fatalf("Expected mean 12.000 but got %v", res[0])
+	}
+}
+
+func TestProcessFileMalformed(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "input")
+	var data strings.Builder
+	for i := 0; i < 100; i++ {
+		switch i % 10 {
+		case 3:
+			fmt.Fprintf(&data, "http://api.tech.com/item/%v  x%v\n", i, i)
+		case 7:
+			fmt.Fprintf(&data, "http://api.tech.com/item/%v\n", i)
+		default:
+			fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i, i)
+		}
+	}
+	err := os.WriteFile(fpath, []byte(data.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		BufSize:     bufSize,
+		NWorkers:    4,
+		TopK:        topK,
+		SegmentSize: 256,
+	}
+	res, stats, err := ProcessFilesStats(context.Background(), []string{fpath}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != topK || res[0].Url != "http://api.tech.com/item/99" {
+		t.Fatalf("Expected `http://api.tech.com/item/99` first, but got %v", res)
+	}
+	if stats.Malformed != 20 || stats.MalformedByKind["value"] != 10 || stats.MalformedByKind["fields"] != 10 {
+		t.Fatalf("Expected 10 value and 10 fields errors, but got %v", stats.MalformedByKind)
+	}
+	if len(stats.Examples) != maxExamples {
+		t.Fatalf("Expected %v examples, but got %v", maxExamples, len(stats.Examples))
+	}
+	for i, e := range stats.Examples {
+		line := strings.SplitN(data.String()[e.Offset:], "\n", 2)[0]
+		if !strings.HasPrefix(line, fmt.Sprintf("http://api.tech.com/item/%v", []int{3, 7, 13, 17, 23}[i])) {
+			t.Fatalf("Expected first malformed lines as examples, but got `%v` at %v", line, i)
+		}
+	}
+
+	opts.Malformed = MalformedSkip
+	_, stats, err = ProcessFilesStats(context.Background(), []string{fpath}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Malformed != 0 {
+		t.Fatalf("Expected malformed lines to be skipped silently, but got %v", stats.Malformed)
+	}
+
+	opts.Malformed = MalformedFail
+	opts.MaxMalformed = 20
+	_, _, err = ProcessFilesStats(context.Background(), []string{fpath}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.MaxMalformed = 5
+	_, _, err = ProcessFilesStats(context.Background(), []string{fpath}, opts)
+	if !errors.Is(err, ErrTooManyMalformed) {
+		t.Fatalf("Expected `%v`, but got `%v`", ErrTooManyMalformed, err)
+	}
+
+	opts.Malformed = MalformedReject
+	opts.RejectsPath = filepath.Join(dir, "rejects")
+	_, stats, err = ProcessFilesStats(context.Background(), []string{fpath}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejects, err := os.ReadFile(opts.RejectsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(rejects)), "\n")
+	if int64(len(lines)) != stats.Malformed || stats.Malformed != 20 {
+		t.Fatalf("Expected 20 rejected lines, but got %v", len(lines))
+	}
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		var offset int64
+		fmt.Sscan(fields[1], &offset)
+		if fields[0] != fpath || !strings.HasPrefix(data.String()[offset:], fields[4]) {
+			t.Fatalf("Rejected line `%v` does not point to the input", line)
+		}
+	}
+}
+
+func TestProcessFileStats(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	var data strings.Builder
+	for i := 0; i < 100; i++ {
+		switch i % 10 {
+		case 3:
+			fmt.Fprintf(&data, "http://api.tech.com/item/%v  x%v\n", i, i)
+		case 5:
+			data.WriteString("\n")
+		default:
+			fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i, i)
+		}
+	}
+	err := os.WriteFile(fpath, []byte(data.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, aggregate := range []Aggregate{AggregateNone, AggregateSum} {
+		opts := Options{
+			BufSize:     bufSize,
+			NWorkers:    3,
+			TopK:        topK,
+			SegmentSize: 256,
+			Aggregate:   aggregate,
+		}
+		_, stats, err := ProcessFilesStats(context.Background(), []string{fpath}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Lines != 100 || stats.EmptyLines != 10 || stats.Parsed != 80 || stats.MalformedByKind["value"] != 10 {
+			t.Fatalf("Expected 100 lines: 10 empty, 80 parsed and 10 malformed, but got %+v", stats)
+		}
+		if stats.BytesRead != int64(data.Len()) || stats.Segments < int64(data.Len())/256 {
+			t.Fatalf("Expected %v bytes read by segments, but got %v in %v segments", data.Len(), stats.BytesRead, stats.Segments)
+		}
+		if len(stats.WorkerBusy) != opts.NWorkers || stats.WallTime <= 0 || stats.MergeTime > stats.WallTime {
+			t.Fatalf("Expected busy time of %v workers within the wall time, but got %+v", opts.NWorkers, stats)
+		}
+		for _, busy := range stats.WorkerBusy {
+			if busy > stats.WallTime {
+				t.Fatalf("Expected busy time within the wall time %v, but got %v", stats.WallTime, busy)
+			}
+		}
+	}
+}
+
+func TestProcessFileSegmentErrors(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "input")
+	var data strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i%30, i)
+	}
+	err := os.WriteFile(fpath, []byte(data.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every segment fails to be opened once if segments are flaky
+	var mx sync.Mutex
+	flaky := true
+	failed := make(map[int64]bool)
+	openSegment = func(segment io.FileSegmentPointer, delimiter []byte) (*io.SegmentReader, error) {
+		mx.Lock()
+		defer mx.Unlock()
+		if flaky && !failed[segment.Start] {
+			failed[segment.Start] = true
+			return nil, os.ErrPermission
+		}
+		return io.OpenSegment(segment, delimiter)
+	}
+	defer func() { openSegment = io.OpenSegment }()
+	for _, aggregate := range []Aggregate{AggregateNone, AggregateSum} {
+		opts := Options{
+			BufSize:     bufSize,
+			NWorkers:    4,
+			TopK:        3,
+			SegmentSize: 256,
+			Aggregate:   aggregate,
+		}
+		flaky = true
+		failed = make(map[int64]bool)
+		_, err = ProcessFiles(context.Background(), []string{fpath}, opts)
+		var segmentsErr *SegmentsError
+		if !errors.As(err, &segmentsErr) || !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("%v: expected segments error, but got `%v`", aggregate, err)
+		}
+		if len(segmentsErr.Segments) != len(failed) || len(failed) < 2 {
+			t.Fatalf("%v: expected all %v segments to fail, but got %v", aggregate, len(failed), segmentsErr.Segments)
+		}
+		for i, segment := range segmentsErr.Segments {
+			if segment.Path != fpath || (i > 0 && segment.Start <= segmentsErr.Segments[i-1].Start) {
+				t.Fatalf("%v: expected failed segments sorted by offset, but got %v", aggregate, segmentsErr.Segments)
+			}
+		}
+		// the same error is returned by the ranker used directly
+		failed = make(map[int64]bool)
+		r, _, err := NewRanker(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.EmitFileSegments(context.Background(), []string{fpath}, opts.BufSize, opts.SegmentSize); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.RankedList(); !errors.As(err, &segmentsErr) {
+			t.Fatalf("%v: expected segments error, but got `%v`", aggregate, err)
+		}
+
+		flaky = false
+		gt, err := ProcessFiles(context.Background(), []string{fpath}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flaky = true
+		failed = make(map[int64]bool)
+		opts.Retries = 1
+		res, err := ProcessFiles(context.Background(), []string{fpath}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(gt) {
+			t.Fatalf("%v: expected %v records, but got %v", aggregate, len(gt), len(res))
+		}
+		for i := range res {
+			if res[i] != gt[i] {
+				t.Fatalf("%v: expected `%v`, but got `%v`", aggregate, gt[i], res[i])
+			}
+		}
+	}
+}
+
+func TestWorkerHeaps(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	var data strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i, i)
+	}
+	err := os.WriteFile(fpath, []byte(data.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		BufSize:  bufSize,
+		NWorkers: 3,
+		TopK:     5,
+	}
+	r, _, err := NewRanker(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.EmitFileSegments(context.Background(), []string{fpath}, bufSize, 256); err != nil {
+		t.Fatal(err)
+	}
+	nHeaps, nRecords := 0, 0
+	for c := range r.heapsChan {
+		nHeaps++
+		nRecords += c.heap.Len()
+	}
+	// every worker emits a single heap for all segments it processed
+	if nHeaps != opts.NWorkers || nRecords < opts.TopK {
+		t.Fatalf("Expected %v heaps, but got %v with %v records", opts.NWorkers, nHeaps, nRecords)
+	}
+}
+
+func TestRankerTuning(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	var data strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i, (i*37)%1000)
+	}
+	err := os.WriteFile(fpath, []byte(data.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		BufSize:  bufSize,
+		NWorkers: 2000,
+		TopK:     3,
+	}
+	gt, err := ProcessFileRecords(context.Background(), fpath, Options{BufSize: bufSize, NWorkers: 1, TopK: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nWorkers := range []int{1, 8} {
+		r, warnings, err := NewRanker(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// clamping is applied to the ranker itself and reported
+		if r.config.getWorkers() != MaxWorkers || len(warnings) != 1 || len(r.Stats().Warnings) != 1 {
+			t.Fatalf("Expected %v workers with a warning, but got %v: %v", MaxWorkers, r.config.getWorkers(), warnings)
+		}
+		if warning, err := r.SetWorkers(MaxWorkers + 1); err != nil || warning == "" || len(r.Stats().Warnings) != 2 {
+			t.Fatalf("Expected warning for %v workers, but got `%v`: %v", MaxWorkers+1, warning, err)
+		}
+		if _, err := r.SetWorkers(0); err == nil {
+			t.Fatal("Expected error for zero workers")
+		}
+		if _, err := r.SetWorkers(nWorkers); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.SetTopK(5); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.EmitFileSegments(context.Background(), []string{fpath}, bufSize, 256); err != nil {
+			t.Fatal(err)
+		}
+		res, err := r.RankedRecords()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(gt) {
+			t.Fatalf("%v workers: expected %v records, but got %v", nWorkers, len(gt), len(res))
+		}
+		for i := range res {
+			if res[i] != gt[i] {
+				t.Fatalf("%v workers: expected `%v`, but got `%v`", nWorkers, gt[i], res[i])
+			}
+		}
+		if _, err := r.SetWorkers(2); err == nil {
+			t.Fatal("Expected error for finished workers")
+		}
+	}
+}
+
+func TestRankerRetiresIdleWorkers(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	var data strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i, i)
+	}
+	if err := os.WriteFile(fpath, []byte(data.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := NewRanker(context.Background(), Options{BufSize: bufSize, NWorkers: 4, TopK: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// idle workers exit right away, so they don't take any of the segments emitted later
+	if _, err := r.SetWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.EmitFileSegments(context.Background(), []string{fpath}, bufSize, 256); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := r.RankedRecords(); err != nil || len(res) != 3 {
+		t.Fatalf("Expected 3 records, but got %v: %v", res, err)
+	}
+	idle := 0
+	for _, busy := range r.Stats().WorkerBusy {
+		if busy == 0 {
+			idle++
+		}
+	}
+	if len(r.Stats().WorkerBusy) != 4 || idle != 3 {
+		t.Fatalf("Expected 3 of 4 workers to stay idle, but got %v", r.Stats().WorkerBusy)
+	}
+}
+
+func TestRankerTuningWhileRunning(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	var data strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i, (i*37)%1000)
+	}
+	err := os.WriteFile(fpath, []byte(data.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuned := make(chan struct{})
+	openSegment = func(segment io.FileSegmentPointer, delimiter []byte) (*io.SegmentReader, error) {
+		<-tuned
+		return io.OpenSegment(segment, delimiter)
+	}
+	defer func() { openSegment = io.OpenSegment }()
+	opts := Options{
+		BufSize:  bufSize,
+		NWorkers: 2,
+		TopK:     10,
+	}
+	r, _, err := NewRanker(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.EmitFileSegments(context.Background(), []string{fpath}, bufSize, 64); err != nil {
+		t.Fatal(err)
+	}
+	// k is decreased and the pool is resized while workers are busy with segments
+	for _, n := range []int{4, 1, 3} {
+		if _, err := r.SetWorkers(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.SetTopK(4); err != nil {
+		t.Fatal(err)
+	}
+	close(tuned)
+	res, err := r.RankedRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 4 {
+		t.Fatalf("Expected 4 records, but got %v", res)
+	}
+	for i := range res {
+		if res[i].Value != int64(999-i) {
+			t.Fatalf("Expected value %v, but got %v", 999-i, res[i])
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	var data strings.Builder
+	nLines := 3000
+	for i := 0; i < nLines; i++ {
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i, i)
+	}
+	err := os.WriteFile(fpath, []byte(data.String()), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segmentSize int64 = 1024
+	segments, err := io.GetFileSegments(context.Background(), fpath, bufSize, segmentSize, io.DefaultDelimiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nSegments int64 = 0
+	for range segments.C {
+		nSegments++
+	}
+	for _, aggregate := range []Aggregate{AggregateNone, AggregateSum} {
+		var reports []Progress
+		opts := Options{
+			BufSize:          bufSize,
+			NWorkers:         3,
+			TopK:             topK,
+			SegmentSize:      segmentSize,
+			Aggregate:        aggregate,
+			ProgressInterval: time.Microsecond,
+			// callback is called from a single goroutine
+			OnProgress: func(p Progress) {
+				reports = append(reports, p)
+			},
+		}
+		if _, err := ProcessFiles(context.Background(), []string{fpath}, opts); err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) == 0 {
+			t.Fatalf("%v: expected progress to be reported", aggregate)
+		}
+		for i := 1; i < len(reports); i++ {
+			prev, p := reports[i-1], reports[i]
+			if p.BytesDone < prev.BytesDone || p.Lines < prev.Lines || p.SegmentsDone < prev.SegmentsDone || p.SegmentsDone > p.SegmentsEmitted {
+				t.Fatalf("%v: expected growing progress, but got %+v after %+v", aggregate, p, prev)
+			}
+		}
+		final := reports[len(reports)-1]
+		gt := Progress{
+			TotalBytes:      int64(data.Len()),
+			BytesDone:       int64(data.Len()),
+			Lines:           int64(nLines),
+			SegmentsEmitted: nSegments,
+			SegmentsDone:    nSegments,
+			Elapsed:         final.Elapsed,
+		}
+		if final != gt || final.Percent() != 100 || final.ETA() != 0 || final.Rate() <= 0 {
+			t.Fatalf("%v: expected final progress %+v, but got %+v", aggregate, gt, final)
+		}
+	}
+	p := Progress{TotalBytes: 1000, BytesDone: 250, Elapsed: time.Second}
+	if p.Percent() != 25 || p.Rate() != 250 || p.ETA() != 3*time.Second {
+		t.Fatalf("Expected 25%%, 250 b/s and 3s left, but got %v, %v and %v", p.Percent(), p.Rate(), p.ETA())
+	}
+}
+
+func TestProcessFileLongLines(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	longUrl := "http://api.tech.com/item/1?q=" + strings.Repeat("a", 10*bufSize)
+	data := "http://api.tech.com/item/2  2\n" + longUrl + "  5\nhttp://api.tech.com/item/3  3\r\n" +
+		longUrl + "  1\nhttp://api.tech.com/item/4  4"
+	err := os.WriteFile(fpath, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{
+		BufSize:  bufSize,
+		NWorkers: 1,
+		TopK:     3,
+	}
+	res, err := ProcessFileRecords(context.Background(), fpath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gt := []string{longUrl, "http://api.tech.com/item/4", "http://api.tech.com/item/3"}
+	for i := range gt {
+		if res[i].Url != gt[i] || !strings.HasPrefix(data[res[i].Offset:], gt[i]) {
+			t.Fatalf("Expected `%v` but got `%v`", gt[i], res[i].Url)
+		}
+	}
+
+	// compressed input is split into in-memory segments, which don't keep the whole oversized lines
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gzPath := fpath + ".gz"
+	if err := os.WriteFile(gzPath, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts.MaxLineLen = 5 * bufSize
+	opts.SegmentSize = bufSize
+	for _, path := range []string{fpath, gzPath} {
+		res, stats, err := ProcessFilesStats(context.Background(), []string{path}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gt = []string{"http://api.tech.com/item/4", "http://api.tech.com/item/3", "http://api.tech.com/item/2"}
+		for i := range gt {
+			if res[i].Url != gt[i] || !strings.HasPrefix(data[res[i].Offset:], gt[i]) {
+				t.Fatalf("%v: expected `%v` but got `%v`", path, gt[i], res[i].Url)
+			}
+		}
+		if stats.MalformedByKind["oversized"] != 2 || stats.Lines != 5 {
+			t.Fatalf("%v: expected 2 oversized lines of 5, but got %v of %v", path, stats.MalformedByKind, stats.Lines)
+		}
+		if !strings.HasPrefix(data[stats.Examples[1].Offset:], longUrl+"  1") {
+			t.Fatalf("%v: offset %v does not point to the oversized line", path, stats.Examples[1].Offset)
+		}
+	}
+}
+
+func TestProcessFileEveryLineOnce(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	property := func(seed int64, nLines uint8, segmentSize uint16, bufSize uint8, nWorkers uint8) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		delimiter := []string{"\n", "\r\n", "\x00"}[rnd.Intn(3)]
+		var data bytes.Buffer
+		offsets := make(map[int64]bool)
+		for i := 0; i < int(nLines); i++ {
+			if rnd.Intn(10) == 0 {
+				data.WriteString(delimiter)
+				continue
+			}
+			offsets[int64(data.Len())] = true
+			fmt.Fprintf(&data, "http://api.tech.com/item/%v%v  %v", i, strings.Repeat("0", rnd.Intn(100)), rnd.Intn(10))
+			if i < int(nLines)-1 || rnd.Intn(2) == 0 {
+				data.WriteString(delimiter)
+			}
+		}
+		if err := os.WriteFile(fpath, data.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		opts := Options{
+			BufSize:          int(bufSize%64) + 16,
+			NWorkers:         int(nWorkers%8) + 1,
+			TopK:             int(nLines) + 1,
+			SegmentSize:      int64(segmentSize % 512),
+			ValidateSegments: true,
+			Delimiter:        []byte(delimiter),
+			Mmap:             runtime.GOOS == "linux" && rnd.Intn(2) == 0,
+		}
+		if opts.SegmentSize != 0 && opts.SegmentSize < int64(opts.BufSize) {
+			opts.SegmentSize += int64(opts.BufSize)
+		}
+		res, err := ProcessFileRecords(context.Background(), fpath, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(offsets) {
+			t.Logf("Expected %v records, but got %v", len(offsets), len(res))
+			return false
+		}
+		for _, rec := range res {
+			if !offsets[rec.Offset] {
+				t.Logf("Record `%v` is processed twice or has wrong offset", rec)
+				return false
+			}
+			delete(offsets, rec.Offset)
+		}
+		return true
+	}
+	err := quick.Check(property, &quick.Config{MaxCount: 200, Rand: rand.New(rand.NewSource(42))})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessFileDelimiters(t *testing.T) {
+	lines := []string{
+		"http://api.tech.com/item/121345  9",
+		"http://api.tech.com/item/122345  350",
+		"http://api.tech.com/item/123345  25",
+		"http://api.tech.com/item/124345  231",
+		"http://api.tech.com/item/125345  111",
+	}
+	gt := []string{
+		"http://api.tech.com/item/122345",
+		"http://api.tech.com/item/124345",
+		"http://api.tech.com/item/125345",
+	}
+	cases := []struct {
+		name      string
+		joiner    string
+		delimiter []byte
+	}{
+		{"LF", "\n", nil},
+		{"CRLF", "\r\n", nil},
+		{"ExplicitCRLF", "\r\n", []byte("\r\n")},
+		{"NUL", "\x00", []byte{0}},
+	}
+	dir := t.TempDir()
+	for _, c := range cases {
+		for _, trailing := range []bool{true, false} {
+			data := strings.Join(lines, c.joiner)
+			if trailing {
+				data += c.joiner
+			}
+			var gz bytes.Buffer
+			w := gzip.NewWriter(&gz)
+			w.Write([]byte(data))
+			w.Close()
+			inputs := map[string][]byte{
+				"plain": []byte(data),
+				"gzip":  gz.Bytes(),
+				"bgzf":  testutil.WriteBGZF(t, []byte(data), 16),
+			}
+			for name, input := range inputs {
+				fpath := filepath.Join(dir, name)
+				if err := os.WriteFile(fpath, input, 0644); err != nil {
+					t.Fatal(err)
+				}
+				res, err := ProcessFileRecords(context.Background(), fpath, Options{
+					BufSize:     16,
+					NWorkers:    3,
+					TopK:        len(gt),
+					SegmentSize: 32,
+					Delimiter:   c.delimiter,
+				})
+				if err != nil {
+					t.Fatalf("%v/%v (trailing delimiter: %v): %v", c.name, name, trailing, err)
+				}
+				if len(res) != len(gt) {
+					t.Fatalf("%v/%v (trailing delimiter: %v): expected %v records, but got %v", c.name, name, trailing, len(gt), len(res))
+				}
+				for i := range gt {
+					if res[i].Url != gt[i] {
+						t.Fatalf("%v/%v (trailing delimiter: %v): expected `%v` but got `%v`", c.name, name, trailing, gt[i], res[i].Url)
+					}
+				}
+			}
+		}
+	}
+
+	_, err := ProcessFileRecords(context.Background(), filepath.Join(dir, "plain"), Options{
+		BufSize:   bufSize,
+		NWorkers:  1,
+		TopK:      topK,
+		Delimiter: []byte("aa"),
+	})
+	if err == nil {
+		t.Fatal("Self-overlapping delimiter should be rejected")
+	}
+}
+
+// stringParser hides raw parsing of the default parser, so every line is parsed from the string
+type stringParser struct {
+	parser record.DefaultParser
+}
+
+func (p stringParser) Parse(line string) (record.Record, error) {
+	return p.parser.Parse(line)
+}
+
+// writePerfData writes lines in the same format as cmd/perf does
+func writePerfData(b *testing.B, nLines int) string {
+	fpath := filepath.Join(b.TempDir(), "input")
+	rnd := rand.New(rand.NewSource(42))
+	var data bytes.Buffer
+	for i := 0; i < nLines; i++ {
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", rnd.Int63(), rnd.Int63())
+	}
+	if err := os.WriteFile(fpath, data.Bytes(), 0644); err != nil {
+		b.Fatal(err)
+	}
+	return fpath
+}
+
+func benchmarkProcessFile(b *testing.B, opts Options) {
+	const nLines = 100000
+	fpath := writePerfData(b, nLines)
+	opts.BufSize = 1024 * 1024
+	opts.NWorkers = 1
+	opts.TopK = 10
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ProcessFileRecords(context.Background(), fpath, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N*nLines), "allocs/line")
+}
+
+func BenchmarkProcessFileStringParser(b *testing.B) {
+	benchmarkProcessFile(b, Options{Parser: stringParser{}})
+}
+
+func BenchmarkProcessFileRawParser(b *testing.B) {
+	benchmarkProcessFile(b, Options{})
+}
+
+// lines are dropped by the value alone, since malformed lines are skipped
+func BenchmarkProcessFileDropByValue(b *testing.B) {
+	benchmarkProcessFile(b, Options{Malformed: MalformedSkip})
+}
+
+func TestProcessFileEarlyRejection(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "input")
+	rnd := rand.New(rand.NewSource(42))
+	valueStrs := []string{"nan", "-inf", "inf", "x", "1 2"}
+	var data bytes.Buffer
+	for i := 0; i < 3000; i++ {
+		value := fmt.Sprint(rnd.Intn(200))
+		if rnd.Intn(50) == 0 {
+			value = valueStrs[rnd.Intn(len(valueStrs))]
+		}
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", rnd.Intn(1000), value)
+	}
+	if err := os.WriteFile(fpath, data.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	formats := []record.ValueFormat{{}, {Type: record.ValueFloat, NaN: record.NaNLowest}, {Type: record.ValueDecimal, Scale: 2}}
+	for _, values := range formats {
+		for _, order := range []Order{OrderDesc, OrderAsc} {
+			for _, includeTies := range []bool{false, true} {
+				comp := newComparator(order, TieBreakFirst, values)
+				gt := newCollector(comp, 10, includeTies)
+				parser := record.DefaultParser{Values: values}
+				var offset int64 = 0
+				for _, line := range strings.SplitAfter(data.String(), "\n") {
+					rec, err := parser.Parse(line)
+					if err == nil {
+						rec.Offset = offset
+						gt.push(rec)
+					}
+					offset += int64(len(line))
+				}
+				want := gt.result()
+				for _, malformed := range []MalformedPolicy{MalformedCount, MalformedSkip} {
+					res, err := ProcessFileRecords(context.Background(), fpath, Options{
+						BufSize:     bufSize,
+						NWorkers:    4,
+						TopK:        10,
+						SegmentSize: 512,
+						Order:       order,
+						IncludeTies: includeTies,
+						Values:      values,
+						Malformed:   malformed,
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(res) != len(want) {
+						t.Fatalf("%v, %v, ties %v, %v: expected %v records, but got %v", values.Type, order, includeTies, malformed, len(want), len(res))
+					}
+					for i := range want {
+						if res[i].Url != want[i].Url || res[i].Offset != want[i].Offset {
+							t.Fatalf("%v, %v, ties %v, %v: expected `%v` but got `%v`", values.Type, order, includeTies, malformed, want[i], res[i])
+						}
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package ranker
+
+import "time"
+
+// Stats holds statistics of the processing run; lines of the failed attempts of retried segments are not counted
+type Stats struct {
+	// Lines is the total amount of scanned lines, including empty lines and headers
+	Lines int64 `json:"lines"`
+	// Parsed is amount of lines parsed into records, including the records dropped early by their values
+	Parsed int64 `json:"parsed"`
+	// EmptyLines is amount of lines without any content
+	EmptyLines int64 `json:"empty_lines"`
+	// Malformed is the total amount of lines which can't be parsed,
+	// they're not counted with the `MalformedSkip` policy
+	Malformed int64 `json:"malformed"`
+	// MalformedByKind counts malformed lines per error kind, which is the reason of the line rejection
+	MalformedByKind map[string]int64 `json:"malformed_by_kind"`
+	// Examples holds the first malformed lines of the inputs
+	Examples []LineError `json:"-"`
+	// Segments is amount of processed segments, including the failed ones
+	Segments int64 `json:"segments"`
+	// BytesRead is the size of the processed segments, compressed blocks are counted for BGZF files
+	// and decompressed data for other compressed inputs
+	BytesRead int64 `json:"bytes_read"`
+	// WorkerBusy holds time spent by every worker processing its segments
+	WorkerBusy []time.Duration `json:"worker_busy_ns"`
+	// MergeTime is the time spent merging results of the workers once they're finished
+	MergeTime time.Duration `json:"merge_time_ns"`
+	// WallTime is the time since the ranker is created till the result is ready
+	WallTime time.Duration `json:"wall_time_ns"`
+	// Warnings holds adjustments of the options made by the ranker, e.g. decreased number of workers
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func newStats() *Stats {
+	return &Stats{MalformedByKind: make(map[string]int64)}
+}
+
+func (s *Stats) addMalformed(lineErr LineError) {
+	s.Malformed++
+	s.MalformedByKind[lineErr.Kind]++
+	s.Examples = addExample(s.Examples, lineErr)
+}
+
+// merge adds stats collected by the other worker
+func (s *Stats) merge(other *Stats) {
+	s.Lines += other.Lines
+	s.Parsed += other.Parsed
+	s.EmptyLines += other.EmptyLines
+	s.Malformed += other.Malformed
+	for kind, n := range other.MalformedByKind {
+		s.MalformedByKind[kind] += n
+	}
+	for _, e := range other.Examples {
+		s.Examples = addExample(s.Examples, e)
+	}
+	s.Segments += other.Segments
+	s.BytesRead += other.BytesRead
+	s.WorkerBusy = append(s.WorkerBusy, other.WorkerBusy...)
+	s.Warnings = append(s.Warnings, other.Warnings...)
+}
@@ -0,0 +1,305 @@
+package record
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parser parses a single line of the input into the Record
+type Parser interface {
+	Parse(line string) (Record, error)
+}
+
+// RawParser is implemented by parsers which parse lines without allocations: url is returned
+// as a slice of the line instead of being set in the record, so the caller can drop records
+// by their values before converting the url to string
+type RawParser interface {
+	Parser
+	ParseRaw(line []byte) (Record, []byte, error)
+}
+
+// ValueParser is implemented by parsers which can parse the value without parsing the rest of the line,
+// so records can be dropped by their values cheaply; the line is not validated, so the full parsing
+// may still fail, and `false` is returned if the value can't be found this way
+type ValueParser interface {
+	ParseValue(line []byte) (Record, bool)
+}
+
+// HeaderParser is implemented by parsers which treat the first line of every input as a header,
+// the header line itself is not parsed as a record
+type HeaderParser interface {
+	Parser
+	// WithHeader returns parser bound to the columns of the provided header line
+	WithHeader(header string) (Parser, error)
+}
+
+// ParserOptions configures built-in parsers
+type ParserOptions struct {
+	// Key and Value select fields holding url and value: for delimited formats
+	// these are column numbers starting from 1 or column names from the header,
+	// for JSON Lines - dot separated paths of the fields
+	Key   string
+	Value string
+	// Header means that the first line of every input is a header, it's implied
+	// if columns of delimited formats are selected by names
+	Header bool
+	// Values defines the type of values, integers by default
+	Values ValueFormat
+}
+
+// ParserFormats holds names of all built-in formats
+var ParserFormats = []string{"default", "fields", "tsv", "csv", "jsonl"}
+
+// NewParser creates one of the built-in parsers by the format name:
+// `default` is a `<url>  <value>` line, `fields` - whitespace separated columns,
+// `tsv` and `csv` - delimited columns, `jsonl` - JSON object per line
+func NewParser(format string, opts ParserOptions) (Parser, error) {
+	if err := opts.Values.Validate(); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(format) {
+	case "", "default":
+		return DefaultParser{Values: opts.Values}, nil
+	case "fields":
+		return NewDelimitedParser(0, opts)
+	case "tsv":
+		return NewDelimitedParser('\t', opts)
+	case "csv":
+		return NewDelimitedParser(',', opts)
+	case "jsonl":
+		return NewJSONParser(opts)
+	}
+	return nil, fmt.Errorf("error: unknown format `%v`, should be one of %v", format, ParserFormats)
+}
+
+// DefaultParser parses lines of exactly two whitespace separated fields: url and value
+type DefaultParser struct {
+	Values ValueFormat
+}
+
+// Parse implements Parser
+func (p DefaultParser) Parse(line string) (Record, error) {
+	return parseRecord(line, p.Values)
+}
+
+// ParseRaw implements RawParser
+func (p DefaultParser) ParseRaw(line []byte) (Record, []byte, error) {
+	return ParseRecordBytes(line, p.Values)
+}
+
+// ParseValue implements ValueParser, value is the last field of the line
+func (p DefaultParser) ParseValue(line []byte) (Record, bool) {
+	end := len(line)
+	for end > 0 && asciiSpace[line[end-1]] {
+		end--
+	}
+	start := end
+	for start > 0 && !asciiSpace[line[start-1]] {
+		if line[start-1] >= utf8.RuneSelf {
+			// non-ASCII whitespaces are handled by the full parsing
+			return Record{}, false
+		}
+		start--
+	}
+	if start == end {
+		return Record{}, false
+	}
+	rec := Record{}
+	if err := p.Values.ParseBytes(line[start:end], &rec); err != nil {
+		return Record{}, false
+	}
+	return rec, true
+}
+
+// DelimitedParser parses lines of columns separated by the delimiter
+type DelimitedParser struct {
+	// Comma is the columns delimiter, zero means any amount of whitespaces
+	Comma       rune
+	KeyColumn   int
+	ValueColumn int
+	Values      ValueFormat
+}
+
+// NewDelimitedParser creates parser of delimited columns, selected by numbers or header names;
+// by default the first column is url and the second one is value
+func NewDelimitedParser(comma rune, opts ParserOptions) (Parser, error) {
+	if opts.Key == "" {
+		opts.Key = "1"
+	}
+	if opts.Value == "" {
+		opts.Value = "2"
+	}
+	p := DelimitedParser{Comma: comma, Values: opts.Values}
+	keyColumn, keyErr := strconv.Atoi(opts.Key)
+	valueColumn, valueErr := strconv.Atoi(opts.Value)
+	if keyErr != nil || valueErr != nil {
+		// columns should be resolved from the header
+		return &delimitedHeaderParser{parser: p, key: opts.Key, value: opts.Value}, nil
+	}
+	if keyColumn < 1 || valueColumn < 1 {
+		return nil, fmt.Errorf("error: column numbers should start from 1")
+	}
+	p.KeyColumn = keyColumn - 1
+	p.ValueColumn = valueColumn - 1
+	if opts.Header {
+		return &delimitedHeaderParser{parser: p}, nil
+	}
+	return p, nil
+}
+
+func (p DelimitedParser) split(line string) ([]string, error) {
+	if p.Comma == 0 {
+		return strings.Fields(line), nil
+	}
+	if p.Comma != '"' && !strings.ContainsRune(line, '"') {
+		return strings.Split(line, string(p.Comma)), nil
+	}
+	// quoted fields need a proper csv parsing
+	r := csv.NewReader(strings.NewReader(line))
+	r.Comma = p.Comma
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	return r.Read()
+}
+
+// Parse implements Parser
+func (p DelimitedParser) Parse(line string) (Record, error) {
+	record := Record{}
+	fields, err := p.split(line)
+	if err != nil {
+		return record, fmt.Errorf("%w: %v", ErrSyntax, err)
+	}
+	if p.KeyColumn >= len(fields) || p.ValueColumn >= len(fields) {
+		return record, fmt.Errorf("%w: record has %v fields, but column %v is required", ErrFields, len(fields), maxInt(p.KeyColumn, p.ValueColumn)+1)
+	}
+	if err := p.Values.Parse(fields[p.ValueColumn], &record); err != nil {
+		return record, err
+	}
+	record.Url = fields[p.KeyColumn]
+	return record, nil
+}
+
+// delimitedHeaderParser skips the header line, resolving columns names if needed
+type delimitedHeaderParser struct {
+	parser DelimitedParser
+	key    string
+	value  string
+}
+
+// Parse implements Parser, should only be used after the header is resolved
+func (p *delimitedHeaderParser) Parse(line string) (Record, error) {
+	if p.key != "" {
+		return Record{}, fmt.Errorf("error: header is not parsed yet")
+	}
+	return p.parser.Parse(line)
+}
+
+// WithHeader implements HeaderParser
+func (p *delimitedHeaderParser) WithHeader(header string) (Parser, error) {
+	if p.key == "" {
+		return p.parser, nil
+	}
+	columns, err := p.parser.split(header)
+	if err != nil {
+		return nil, err
+	}
+	parser := p.parser
+	parser.KeyColumn, parser.ValueColumn = -1, -1
+	for i, column := range columns {
+		column = strings.TrimSpace(column)
+		if column == p.key && parser.KeyColumn < 0 {
+			parser.KeyColumn = i
+		}
+		if column == p.value && parser.ValueColumn < 0 {
+			parser.ValueColumn = i
+		}
+	}
+	if parser.KeyColumn < 0 || parser.ValueColumn < 0 {
+		return nil, fmt.Errorf("error: header should contain `%v` and `%v` columns", p.key, p.value)
+	}
+	return parser, nil
+}
+
+// JSONParser parses JSON Lines, where each line is an object holding url and value
+type JSONParser struct {
+	KeyPath   []string
+	ValuePath []string
+	Values    ValueFormat
+}
+
+// NewJSONParser creates JSON Lines parser, by default `url` and `value` fields are used
+func NewJSONParser(opts ParserOptions) (Parser, error) {
+	if opts.Key == "" {
+		opts.Key = "url"
+	}
+	if opts.Value == "" {
+		opts.Value = "value"
+	}
+	return JSONParser{
+		KeyPath:   strings.Split(opts.Key, "."),
+		ValuePath: strings.Split(opts.Value, "."),
+		Values:    opts.Values,
+	}, nil
+}
+
+func lookupJSON(obj interface{}, path []string) (interface{}, bool) {
+	for _, name := range path {
+		m, ok := obj.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		obj, ok = m[name]
+		if !ok {
+			return nil, false
+		}
+	}
+	return obj, true
+}
+
+// Parse implements Parser
+func (p JSONParser) Parse(line string) (Record, error) {
+	record := Record{}
+	var obj interface{}
+	d := json.NewDecoder(strings.NewReader(line))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil {
+		return record, fmt.Errorf("%w: %v", ErrSyntax, err)
+	}
+	key, ok := lookupJSON(obj, p.KeyPath)
+	if !ok {
+		return record, fmt.Errorf("%w: field `%v` not found", ErrFields, strings.Join(p.KeyPath, "."))
+	}
+	value, ok := lookupJSON(obj, p.ValuePath)
+	if !ok {
+		return record, fmt.Errorf("%w: field `%v` not found", ErrFields, strings.Join(p.ValuePath, "."))
+	}
+	switch k := key.(type) {
+	case string:
+		record.Url = k
+	case json.Number:
+		record.Url = k.String()
+	default:
+		return record, fmt.Errorf("%w: field `%v` should be a string", ErrSyntax, strings.Join(p.KeyPath, "."))
+	}
+	var err error
+	switch v := value.(type) {
+	case json.Number:
+		err = p.Values.Parse(v.String(), &record)
+	case string:
+		err = p.Values.Parse(v, &record)
+	default:
+		err = fmt.Errorf("%w: field `%v` should be a number", ErrValue, strings.Join(p.ValuePath, "."))
+	}
+	return record, err
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
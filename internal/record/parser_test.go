@@ -0,0 +1,120 @@
+package record
+
+import "testing"
+
+func TestNewParser(t *testing.T) {
+	if _, err := NewParser("xml", ParserOptions{}); err == nil {
+		t.Fatal("Expected error for unknown format")
+	}
+	if _, err := NewParser("csv", ParserOptions{Key: "0", Value: "1"}); err == nil {
+		t.Fatal("Expected error for zero column number")
+	}
+	p, err := NewParser("default", ParserOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := p.Parse("http://api.tech.com/item/121345  9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Url != "http://api.tech.com/item/121345" || rec.Value != 9 {
+		t.Fatalf("Expected default record but got %v", rec)
+	}
+}
+
+func TestDelimitedParser(t *testing.T) {
+	cases := []struct {
+		format string
+		opts   ParserOptions
+		line   string
+		url    string
+		value  int64
+	}{
+		{"fields", ParserOptions{Key: "3", Value: "1"}, "12  GET\t/item/1 200", "/item/1", 12},
+		{"tsv", ParserOptions{}, "/item/2\t7", "/item/2", 7},
+		{"csv", ParserOptions{Key: "2", Value: "3"}, `1,"/item/3,a", 42 `, "/item/3,a", 42},
+	}
+	for _, c := range cases {
+		p, err := NewParser(c.format, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec, err := p.Parse(c.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Url != c.url || rec.Value != c.value {
+			t.Fatalf("Expected `%v  %v` but got %v", c.url, c.value, rec)
+		}
+	}
+	p, _ := NewParser("tsv", ParserOptions{Key: "1", Value: "3"})
+	if _, err := p.Parse("/item/1\t2"); err == nil {
+		t.Fatal("Expected error for missing column")
+	}
+}
+
+func TestDelimitedHeaderParser(t *testing.T) {
+	p, err := NewParser("csv", ParserOptions{Key: "path", Value: "latency"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hp, ok := p.(HeaderParser)
+	if !ok {
+		t.Fatal("Expected header parser when columns are selected by names")
+	}
+	if _, err := hp.WithHeader("path,status"); err == nil {
+		t.Fatal("Expected error for missing header column")
+	}
+	bound, err := hp.WithHeader("status, latency ,path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := bound.Parse("200,31,/item/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Url != "/item/1" || rec.Value != 31 {
+		t.Fatalf("Expected `/item/1  31` but got %v", rec)
+	}
+
+	p, _ = NewParser("tsv", ParserOptions{Header: true})
+	if _, ok := p.(HeaderParser); !ok {
+		t.Fatal("Expected header parser when header is set")
+	}
+	p, _ = NewParser("tsv", ParserOptions{})
+	if _, ok := p.(HeaderParser); ok {
+		t.Fatal("Expected plain parser without header")
+	}
+}
+
+func TestJSONParser(t *testing.T) {
+	p, err := NewParser("jsonl", ParserOptions{Key: "req.url", Value: "stats.hits"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := p.Parse(`{"req": {"url": "/item/1"}, "stats": {"hits": 5}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Url != "/item/1" || rec.Value != 5 {
+		t.Fatalf("Expected `/item/1  5` but got %v", rec)
+	}
+	for _, line := range []string{
+		`{"req": {"url": "/item/1"}}`,
+		`{"req": {"url": "/item/1"}, "stats": {"hits": 1.5}}`,
+		`{"req": {"url": ["/item/1"]}, "stats": {"hits": 1}}`,
+		`{"req": `,
+	} {
+		if _, err := p.Parse(line); err == nil {
+			t.Fatalf("Expected error for line `%v`", line)
+		}
+	}
+	p, _ = NewParser("jsonl", ParserOptions{})
+	rec, err = p.Parse(`{"url": "/item/2", "value": "17"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Url != "/item/2" || rec.Value != 17 {
+		t.Fatalf("Expected `/item/2  17` but got %v", rec)
+	}
+}
@@ -1,36 +1,131 @@
 package record
 
 import (
+	"errors"
 	"fmt"
-	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Parsers wrap errors of malformed lines with one of these kinds
+var (
+	// ErrFields means that the line misses some of the required fields
+	ErrFields = errors.New("wrong fields")
+	// ErrValue means that the value can't be parsed
+	ErrValue = errors.New("invalid value")
+	// ErrSyntax means that the line structure can't be parsed
+	ErrSyntax = errors.New("invalid syntax")
+	// ErrOversized means that the line is longer than the max line length
+	ErrOversized = errors.New("line is too long")
+)
+
+// ErrorKind returns short name of the parse error kind: `fields`, `value`, `syntax`, `oversized` or `other`
+func ErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrFields):
+		return "fields"
+	case errors.Is(err, ErrValue):
+		return "value"
+	case errors.Is(err, ErrSyntax):
+		return "syntax"
+	case errors.Is(err, ErrOversized):
+		return "oversized"
+	}
+	return "other"
+}
+
 // Record holds url data presented in files
 type Record struct {
-	Url   string
+	Url string
+	// Value holds integer values and decimals, multiplied by 10^scale
 	Value int64
+	// Float holds float values; for means of integers and decimals it holds
+	// the unrounded mean in units of Value, which they are ranked by
+	Float float64
+	// Offset is a byte offset of the line in the source file
+	Offset int64
+	// Source is an index of the source file among all inputs ranked together
+	Source int
 }
 
 // ParseRecord parses input string and creates Record object from it
 func ParseRecord(str string) (Record, error) {
+	return parseRecord(str, ValueFormat{})
+}
+
+func parseRecord(str string, values ValueFormat) (Record, error) {
 	strSlice := strings.Fields(str)
 	strSliceLen := len(strSlice)
 	record := Record{}
 	if strSliceLen != 2 {
-		return record, fmt.Errorf("record should consist of exactly 2 fields, but got %v", strSliceLen)
+		return record, fmt.Errorf("%w: record should consist of exactly 2 fields, but got %v", ErrFields, strSliceLen)
 	}
-	parsedVal, err := strconv.ParseInt(strSlice[1], 10, 64)
-	if err != nil {
+	if err := values.Parse(strSlice[1], &record); err != nil {
 		return record, err
 	}
 	record.Url = strSlice[0]
-	record.Value = parsedVal
 	return record, nil
 }
 
-// Equal small helper function to compare two Records
+// ParseRecordBytes parses the line the same way as ParseRecord, but without allocations:
+// url is returned as a slice of the line instead of being set in the record,
+// so the caller converts it to string only if the record is kept
+func ParseRecordBytes(line []byte, values ValueFormat) (Record, []byte, error) {
+	record := Record{}
+	fields, n := splitFields(line)
+	if n != 2 {
+		return record, nil, fmt.Errorf("%w: record should consist of exactly 2 fields, but got %v", ErrFields, n)
+	}
+	if err := values.ParseBytes(fields[1], &record); err != nil {
+		return record, nil, err
+	}
+	return record, fields[0], nil
+}
+
+// asciiSpace marks whitespaces the same way as unicode.IsSpace does for ASCII
+var asciiSpace = [256]bool{'\t': true, '\n': true, '\v': true, '\f': true, '\r': true, ' ': true}
+
+// splitFields splits the line by whitespaces the same way as strings.Fields,
+// but only the first two fields are returned along with the total amount of fields
+func splitFields(line []byte) ([2][]byte, int) {
+	var fields [2][]byte
+	n := 0
+	start := -1
+	for i := 0; i < len(line); {
+		size := 1
+		isSpace := asciiSpace[line[i]]
+		if line[i] >= utf8.RuneSelf {
+			var r rune
+			r, size = utf8.DecodeRune(line[i:])
+			isSpace = unicode.IsSpace(r)
+		}
+		if isSpace && start >= 0 {
+			if n < len(fields) {
+				fields[n] = line[start:i]
+			}
+			n++
+			start = -1
+		} else if !isSpace && start < 0 {
+			start = i
+		}
+		i += size
+	}
+	if start >= 0 {
+		if n < len(fields) {
+			fields[n] = line[start:]
+		}
+		n++
+	}
+	return fields, n
+}
+
+// Equal small helper function to compare two Records (offsets and sources are ignored)
 func Equal(a, b Record) bool {
-	return strings.Compare(a.Url, b.Url) == 0 &&
-		a.Value == b.Value
+	return strings.Compare(a.Url, b.Url) == 0 && SameValue(a, b)
+}
+
+// SameValue checks whether records hold equal values of any type, NaNs are considered equal
+func SameValue(a, b Record) bool {
+	return a.Value == b.Value && (a.Float == b.Float || (a.Float != a.Float && b.Float != b.Float))
 }
@@ -1,6 +1,12 @@
 package record
 
-import "testing"
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/quick"
+)
 
 func TestRecordParser(t *testing.T) {
 	gt := Record{
@@ -19,3 +25,79 @@ func TestRecordParser(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestErrorKind(t *testing.T) {
+	cases := map[string]string{
+		"http://api.tech.com/item/121345":      "fields",
+		"http://api.tech.com/item/121345  9.5": "value",
+	}
+	for line, kind := range cases {
+		_, err := ParseRecord(line)
+		if ErrorKind(err) != kind {
+			t.Fatalf("Expected `%v` error kind but got `%v`", kind, ErrorKind(err))
+		}
+	}
+	p, _ := NewParser("jsonl", ParserOptions{})
+	_, err := p.Parse("{")
+	if ErrorKind(err) != "syntax" {
+		t.Fatalf("Expected `syntax` error kind but got `%v`", ErrorKind(err))
+	}
+}
+
+func TestParseRecordBytes(t *testing.T) {
+	alphabet := []string{"a", "/", "1", "9", "-", ".", " ", "  ", "\t", "\u00a0", "\u2003", "\xff", "é"}
+	property := func(seed int64, n uint8, decimal bool) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		line := ""
+		for i := 0; i < int(n%16); i++ {
+			line += alphabet[rnd.Intn(len(alphabet))]
+		}
+		values := ValueFormat{}
+		if decimal {
+			values = ValueFormat{Type: ValueDecimal, Scale: 2}
+		}
+		gt, gtErr := parseRecord(line, values)
+		rec, url, err := ParseRecordBytes([]byte(line), values)
+		if gtErr == nil {
+			rec.Url = string(url)
+		}
+		if fmt.Sprint(err) != fmt.Sprint(gtErr) || (err == nil && rec != gt) {
+			t.Logf("%q: expected %v and error `%v`, but got %v and `%v`", line, gt, gtErr, rec, err)
+			return false
+		}
+		// value parsed alone should be the same for valid lines, it may be not found only in non-ASCII lines
+		value, ok := DefaultParser{Values: values}.ParseValue([]byte(line))
+		if gtErr == nil && (ok && !SameValue(value, gt) || !ok && !strings.ContainsAny(line, "\u00a0\u2003\xffé")) {
+			t.Logf("%q: expected value of %v, but got %v (%v)", line, gt, value, ok)
+			return false
+		}
+		return true
+	}
+	err := quick.Check(property, &quick.Config{MaxCount: 5000, Rand: rand.New(rand.NewSource(42))})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// perfLine is a line of the dataset generated by cmd/perf
+const perfLine = "http://api.tech.com/item/5577006791947779410  8674665223082153551"
+
+func BenchmarkParseRecord(b *testing.B) {
+	b.ReportAllocs()
+	line := []byte(perfLine)
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseRecord(string(line)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseRecordBytes(b *testing.B) {
+	b.ReportAllocs()
+	line := []byte(perfLine)
+	for i := 0; i < b.N; i++ {
+		if _, _, err := ParseRecordBytes(line, ValueFormat{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
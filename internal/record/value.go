@@ -0,0 +1,333 @@
+package record
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ValueType defines how values of records are parsed, compared and printed
+type ValueType int
+
+const (
+	// ValueInt values are stored in Record.Value
+	ValueInt ValueType = iota
+	// ValueFloat values are stored in Record.Float
+	ValueFloat
+	// ValueDecimal values are exact decimals with the fixed scale,
+	// stored in Record.Value as integers multiplied by 10^scale
+	ValueDecimal
+)
+
+func (t ValueType) String() string {
+	switch t {
+	case ValueInt:
+		return "int"
+	case ValueFloat:
+		return "float"
+	case ValueDecimal:
+		return "decimal"
+	}
+	return fmt.Sprintf("ValueType(%d)", int(t))
+}
+
+// ParseValueType returns value type by its name: `int`, `float` or `decimal`
+func ParseValueType(name string) (ValueType, error) {
+	switch strings.ToLower(name) {
+	case "int":
+		return ValueInt, nil
+	case "float":
+		return ValueFloat, nil
+	case "decimal":
+		return ValueDecimal, nil
+	}
+	return ValueInt, fmt.Errorf("error: unknown value type `%v`", name)
+}
+
+// NaNPolicy defines how NaN and infinite float values are handled
+type NaNPolicy int
+
+const (
+	// NaNReject rejects NaN and infinite values as malformed
+	NaNReject NaNPolicy = iota
+	// NaNLowest keeps infinite values in their natural order and ranks NaN below any other value
+	NaNLowest
+	// NaNHighest keeps infinite values in their natural order and ranks NaN above any other value
+	NaNHighest
+)
+
+func (p NaNPolicy) String() string {
+	switch p {
+	case NaNReject:
+		return "reject"
+	case NaNLowest:
+		return "lowest"
+	case NaNHighest:
+		return "highest"
+	}
+	return fmt.Sprintf("NaNPolicy(%d)", int(p))
+}
+
+// ParseNaNPolicy returns NaN policy by its name: `reject`, `lowest` or `highest`
+func ParseNaNPolicy(name string) (NaNPolicy, error) {
+	switch strings.ToLower(name) {
+	case "reject":
+		return NaNReject, nil
+	case "lowest":
+		return NaNLowest, nil
+	case "highest":
+		return NaNHighest, nil
+	}
+	return NaNReject, fmt.Errorf("error: unknown NaN policy `%v`", name)
+}
+
+// MaxDecimalScale is the max amount of fractional digits of decimals
+const MaxDecimalScale = 18
+
+// ValueFormat describes values of records; zero value means integer values
+type ValueFormat struct {
+	Type ValueType
+	// Scale is amount of fractional digits of decimals
+	Scale int
+	// NaN defines how NaN and infinite floats are handled
+	NaN NaNPolicy
+}
+
+// Validate checks that the format is supported
+func (f ValueFormat) Validate() error {
+	if f.Type < ValueInt || f.Type > ValueDecimal {
+		return fmt.Errorf("error: unknown value type %v", f.Type)
+	}
+	if f.Scale < 0 || f.Scale > MaxDecimalScale {
+		return fmt.Errorf("error: decimal scale should be in [0, %v]", MaxDecimalScale)
+	}
+	if f.NaN < NaNReject || f.NaN > NaNHighest {
+		return fmt.Errorf("error: unknown NaN policy %v", f.NaN)
+	}
+	return nil
+}
+
+// Parse parses the value string into the corresponding field of the record
+func (f ValueFormat) Parse(str string, rec *Record) error {
+	if err := f.parse(str, rec); err != nil {
+		return fmt.Errorf("%w: %v", ErrValue, err)
+	}
+	return nil
+}
+
+// ParseBytes works the same way as Parse, but integers and decimals are parsed without allocations;
+// values which don't fit the fast path are parsed by Parse, so results and errors are the same
+func (f ValueFormat) ParseBytes(b []byte, rec *Record) error {
+	switch f.Type {
+	case ValueInt:
+		if v, ok := parseIntBytes(b); ok {
+			rec.Value = v
+			return nil
+		}
+	case ValueDecimal:
+		if v, ok := parseDecimalBytes(b, f.Scale); ok {
+			rec.Value = v
+			return nil
+		}
+	}
+	return f.Parse(string(b), rec)
+}
+
+func (f ValueFormat) parse(str string, rec *Record) error {
+	str = strings.TrimSpace(str)
+	switch f.Type {
+	case ValueFloat:
+		v, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return err
+		}
+		if f.NaN == NaNReject && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			return fmt.Errorf("non-finite value `%v`", str)
+		}
+		rec.Float = v
+		return nil
+	case ValueDecimal:
+		v, err := parseDecimal(str, f.Scale)
+		if err != nil {
+			return err
+		}
+		rec.Value = v
+		return nil
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return err
+	}
+	rec.Value = v
+	return nil
+}
+
+// parseDecimal parses decimal string into an integer multiplied by 10^scale;
+// values with more significant fractional digits than the scale are rejected, since they can't be kept exactly
+func parseDecimal(str string, scale int) (int64, error) {
+	intPart, fracPart := str, ""
+	if i := strings.IndexByte(str, '.'); i >= 0 {
+		intPart, fracPart = str[:i], str[i+1:]
+	}
+	sign := ""
+	if strings.HasPrefix(intPart, "-") || strings.HasPrefix(intPart, "+") {
+		sign, intPart = intPart[:1], intPart[1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("invalid decimal `%v`", str)
+	}
+	for _, part := range []string{intPart, fracPart} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("invalid decimal `%v`", str)
+			}
+		}
+	}
+	fracPart = strings.TrimRight(fracPart, "0")
+	if len(fracPart) > scale {
+		return 0, fmt.Errorf("decimal `%v` has more than %v fractional digits", str, scale)
+	}
+	digits := sign + intPart + fracPart + strings.Repeat("0", scale-len(fracPart))
+	v, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("decimal `%v` is out of range: %w", str, err)
+	}
+	return v, nil
+}
+
+// parseIntBytes parses optionally signed decimal integer, it fails on any other input
+// including overflows, which are left to strconv for the proper errors
+func parseIntBytes(b []byte) (int64, bool) {
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		b = b[1:]
+	}
+	v, ok := accumulateDigits(0, b)
+	if !ok || len(b) == 0 {
+		return 0, false
+	}
+	return signed(v, neg)
+}
+
+// parseDecimalBytes parses decimal into an integer multiplied by 10^scale the same way as parseDecimal,
+// it fails on any input which parseDecimal would reject or which needs trimming
+func parseDecimalBytes(b []byte, scale int) (int64, bool) {
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		b = b[1:]
+	}
+	intPart, fracPart := b, []byte(nil)
+	for i, c := range b {
+		if c == '.' {
+			intPart, fracPart = b[:i], b[i+1:]
+			break
+		}
+	}
+	for len(fracPart) > 0 && fracPart[len(fracPart)-1] == '0' {
+		fracPart = fracPart[:len(fracPart)-1]
+	}
+	if (len(intPart) == 0 && len(fracPart) == 0) || len(fracPart) > scale {
+		return 0, false
+	}
+	v, ok := accumulateDigits(0, intPart)
+	if !ok {
+		return 0, false
+	}
+	v, ok = accumulateDigits(v, fracPart)
+	for i := len(fracPart); ok && i < scale; i++ {
+		ok = v <= math.MaxUint64/10
+		v *= 10
+	}
+	if !ok {
+		return 0, false
+	}
+	return signed(v, neg)
+}
+
+// accumulateDigits appends decimal digits to the value, it fails on non-digits and overflows
+func accumulateDigits(v uint64, digits []byte) (uint64, bool) {
+	for _, c := range digits {
+		if c < '0' || c > '9' || v > (math.MaxUint64-9)/10 {
+			return 0, false
+		}
+		v = v*10 + uint64(c-'0')
+	}
+	return v, true
+}
+
+func signed(v uint64, neg bool) (int64, bool) {
+	if neg {
+		if v > 1<<63 {
+			return 0, false
+		}
+		return -int64(v), true
+	}
+	if v > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(v), true
+}
+
+// Compare returns -1, 0 or 1 if value of record `a` is less, equal or greater than the value of `b`
+func (f ValueFormat) Compare(a, b Record) int {
+	if f.Type == ValueFloat {
+		return compareFloats(a.Float, b.Float, f.NaN)
+	}
+	switch {
+	case a.Value < b.Value:
+		return -1
+	case a.Value > b.Value:
+		return 1
+	}
+	return 0
+}
+
+// compareFloats orders floats totally: all NaNs are equal and placed according to the policy
+func compareFloats(a, b float64, policy NaNPolicy) int {
+	aNaN, bNaN := a != a, b != b
+	if aNaN || bNaN {
+		switch {
+		case aNaN && bNaN:
+			return 0
+		case aNaN == (policy == NaNHighest):
+			return 1
+		}
+		return -1
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Format returns the string representation of the record value
+func (f ValueFormat) Format(rec Record) string {
+	switch f.Type {
+	case ValueFloat:
+		return strconv.FormatFloat(rec.Float, 'g', -1, 64)
+	case ValueDecimal:
+		return formatDecimal(rec.Value, f.Scale)
+	}
+	return strconv.FormatInt(rec.Value, 10)
+}
+
+func formatDecimal(v int64, scale int) string {
+	digits := strconv.FormatInt(v, 10)
+	if scale == 0 {
+		return digits
+	}
+	sign := ""
+	if v < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
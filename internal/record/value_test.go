@@ -0,0 +1,105 @@
+package record
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	cases := []struct {
+		format ValueFormat
+		str    string
+		gt     Record
+		ok     bool
+	}{
+		{ValueFormat{}, "42", Record{Value: 42}, true},
+		{ValueFormat{}, "4.2", Record{}, false},
+		{ValueFormat{Type: ValueFloat}, "0.352", Record{Float: 0.352}, true},
+		{ValueFormat{Type: ValueFloat}, "-1e3", Record{Float: -1000}, true},
+		{ValueFormat{Type: ValueFloat}, "NaN", Record{}, false},
+		{ValueFormat{Type: ValueFloat}, "+Inf", Record{}, false},
+		{ValueFormat{Type: ValueFloat, NaN: NaNLowest}, "-Inf", Record{Float: math.Inf(-1)}, true},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "12.34", Record{Value: 1234}, true},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "-0.5", Record{Value: -50}, true},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "7", Record{Value: 700}, true},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, ".25", Record{Value: 25}, true},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "1.2300", Record{Value: 123}, true},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "1.234", Record{}, false},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "1e3", Record{}, false},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "-.", Record{}, false},
+		{ValueFormat{Type: ValueDecimal, Scale: 18}, "10", Record{}, false},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "-92233720368547758.08", Record{Value: math.MinInt64}, true},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, "92233720368547758.08", Record{}, false},
+		{ValueFormat{}, "+5", Record{Value: 5}, true},
+		{ValueFormat{}, " 5", Record{Value: 5}, true},
+		{ValueFormat{}, "", Record{}, false},
+		{ValueFormat{}, "-", Record{}, false},
+		{ValueFormat{}, "9223372036854775807", Record{Value: math.MaxInt64}, true},
+		{ValueFormat{}, "-9223372036854775808", Record{Value: math.MinInt64}, true},
+		{ValueFormat{}, "9223372036854775808", Record{}, false},
+		{ValueFormat{}, "99999999999999999999", Record{}, false},
+	}
+	for _, c := range cases {
+		rec := Record{}
+		err := c.format.Parse(c.str, &rec)
+		if (err == nil) != c.ok {
+			t.Fatalf("%v `%v`: expected success %v, but got error %v", c.format.Type, c.str, c.ok, err)
+		}
+		if c.ok && rec != c.gt {
+			t.Fatalf("%v `%v`: expected %v, but got %v", c.format.Type, c.str, c.gt, rec)
+		}
+		raw := Record{}
+		rawErr := c.format.ParseBytes([]byte(c.str), &raw)
+		if raw != rec || fmt.Sprint(rawErr) != fmt.Sprint(err) {
+			t.Fatalf("%v `%v`: expected %v and error `%v` from bytes, but got %v and `%v`", c.format.Type, c.str, rec, err, raw, rawErr)
+		}
+	}
+	if err := (ValueFormat{Scale: MaxDecimalScale + 1}).Validate(); err == nil {
+		t.Fatal("Expected error for too large scale")
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	nan := Record{Float: math.NaN()}
+	inf := Record{Float: math.Inf(1)}
+	one := Record{Float: 1}
+	lowest := ValueFormat{Type: ValueFloat, NaN: NaNLowest}
+	highest := ValueFormat{Type: ValueFloat, NaN: NaNHighest}
+	if lowest.Compare(nan, one) != -1 || lowest.Compare(inf, nan) != 1 {
+		t.Fatal("NaN should be lower than any other value")
+	}
+	if highest.Compare(nan, inf) != 1 || highest.Compare(one, nan) != -1 {
+		t.Fatal("NaN should be higher than any other value")
+	}
+	if highest.Compare(nan, nan) != 0 || !SameValue(nan, nan) {
+		t.Fatal("NaNs should be equal")
+	}
+	if highest.Compare(inf, one) != 1 {
+		t.Fatal("+Inf should be higher than finite value")
+	}
+	decimals := ValueFormat{Type: ValueDecimal, Scale: 2}
+	if decimals.Compare(Record{Value: -50}, Record{Value: 3}) != -1 {
+		t.Fatal("-0.50 should be lower than 0.03")
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	cases := []struct {
+		format ValueFormat
+		rec    Record
+		gt     string
+	}{
+		{ValueFormat{}, Record{Value: -7}, "-7"},
+		{ValueFormat{Type: ValueFloat}, Record{Float: 0.352}, "0.352"},
+		{ValueFormat{Type: ValueFloat}, Record{Float: math.NaN()}, "NaN"},
+		{ValueFormat{Type: ValueDecimal, Scale: 2}, Record{Value: 1234}, "12.34"},
+		{ValueFormat{Type: ValueDecimal, Scale: 3}, Record{Value: -5}, "-0.005"},
+		{ValueFormat{Type: ValueDecimal}, Record{Value: 5}, "5"},
+	}
+	for _, c := range cases {
+		if s := c.format.Format(c.rec); s != c.gt {
+			t.Fatalf("Expected `%v` but got `%v`", c.gt, s)
+		}
+	}
+}
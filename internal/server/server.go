@@ -0,0 +1,497 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/ranker"
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+)
+
+// submitJob queues the ranking job in the pool, it's replaced in tests to control jobs execution
+var submitJob = (*ranker.Pool).Submit
+
+// Job statuses
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusDone      = "done"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+const (
+	// DefaultMaxUpload is the max size of the uploaded input if it's not set
+	DefaultMaxUpload = 1 << 30
+	// DefaultJobTTL is how long finished jobs are kept if it's not set
+	DefaultJobTTL = 10 * time.Minute
+)
+
+// Config holds parameters of the server
+type Config struct {
+	// MaxJobs is the max number of jobs processed simultaneously by the pool, other jobs wait in the queue
+	MaxJobs int
+	// MaxUpload limits size of the uploaded input in bytes
+	MaxUpload int64
+	// JobTTL is how long the finished job is kept, it's forgotten afterwards
+	JobTTL time.Duration
+	// UploadDir is where uploaded inputs are kept while their jobs run, the temp dir by default
+	UploadDir string
+	// Root is the directory with server-local inputs, jobs can't read files outside of it;
+	// ranking of server-local files is disabled if it's empty
+	Root string
+	// Defaults holds parameters of the ranker used when the job doesn't set them
+	Defaults ranker.Options
+}
+
+// Server runs ranking jobs requested over HTTP in the shared pool:
+//
+//	POST /jobs?path=<path>&k=<k>...  ranks the server-local file, or the request body if path isn't set
+//	GET /jobs/<id>                   returns status of the job
+//	GET /jobs/<id>/result            returns ranked records of the finished job
+//	DELETE /jobs/<id>                cancels the job and forgets it
+//
+// finished jobs are forgotten after `JobTTL`
+type Server struct {
+	config Config
+	pool   *ranker.Pool
+	mu     sync.Mutex
+	jobs   map[string]*job
+	wg     sync.WaitGroup
+}
+
+type job struct {
+	id       string
+	poolID   ranker.JobID
+	status   string
+	err      error
+	values   record.ValueFormat
+	records  []record.Record
+	stats    *ranker.Stats
+	progress ranker.Progress
+	started  time.Time
+	finished time.Time
+	cancel   context.CancelFunc
+	// expiry forgets the finished job once it's kept for too long
+	expiry *time.Timer
+}
+
+// New creates the server, zero parameters of the ranker are replaced by the defaults of the filereader
+func New(config Config) *Server {
+	if config.MaxJobs <= 0 {
+		config.MaxJobs = 1
+	}
+	if config.MaxUpload <= 0 {
+		config.MaxUpload = DefaultMaxUpload
+	}
+	if config.JobTTL <= 0 {
+		config.JobTTL = DefaultJobTTL
+	}
+	defaults := &config.Defaults
+	if defaults.BufSize == 0 {
+		defaults.BufSize = 1024 * 1024
+	}
+	if defaults.NWorkers == 0 {
+		defaults.NWorkers = 4
+	}
+	if defaults.TopK == 0 {
+		defaults.TopK = 10
+	}
+	if defaults.SegmentSize == 0 {
+		defaults.SegmentSize = 2 * 1024 * 1024
+	}
+	return &Server{
+		config: config,
+		pool:   ranker.NewPool(ranker.PoolOptions{MaxJobs: config.MaxJobs}),
+		jobs:   make(map[string]*job),
+	}
+}
+
+// Close cancels all the jobs, waits for them to finish and stops the pool
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, j := range s.jobs {
+		j.cancel()
+		if j.expiry != nil {
+			j.expiry.Stop()
+		}
+	}
+	s.mu.Unlock()
+	s.pool.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if parts[0] != "jobs" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "result") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("error: unknown path %v", req.URL.Path))
+		return
+	}
+	switch {
+	case len(parts) == 1 && req.Method == http.MethodPost:
+		s.createJob(w, req)
+	case len(parts) == 2 && req.Method == http.MethodGet:
+		s.jobStatus(w, parts[1])
+	case len(parts) == 2 && req.Method == http.MethodDelete:
+		s.deleteJob(w, parts[1])
+	case len(parts) == 3 && req.Method == http.MethodGet:
+		s.jobResult(w, parts[1])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("error: method %v is not allowed for %v", req.Method, req.URL.Path))
+	}
+}
+
+// jobParams parses parameters of the job passed in the query
+func (s *Server) jobParams(query map[string][]string) (ranker.Options, error) {
+	opts := s.config.Defaults
+	get := func(name string) string {
+		if v := query[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	ints := map[string]*int{"k": &opts.TopK, "workers": &opts.NWorkers, "buf": &opts.BufSize}
+	for name, v := range ints {
+		if str := get(name); str != "" {
+			n, err := strconv.Atoi(str)
+			if err != nil {
+				return opts, fmt.Errorf("error: invalid `%v` parameter: %w", name, err)
+			}
+			if n <= 0 {
+				return opts, fmt.Errorf("error: `%v` parameter should be a positive number", name)
+			}
+			*v = n
+		}
+	}
+	if str := get("segment"); str != "" {
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("error: invalid `segment` parameter: %w", err)
+		}
+		if n < 0 {
+			return opts, fmt.Errorf("error: `segment` parameter should be a non-negative number")
+		}
+		opts.SegmentSize = n
+	}
+	if str := get("order"); str != "" {
+		order, err := ranker.ParseOrder(str)
+		if err != nil {
+			return opts, err
+		}
+		opts.Order = order
+	}
+	values := record.ValueFormat{Scale: 2}
+	if str := get("valuetype"); str != "" {
+		valueType, err := record.ParseValueType(str)
+		if err != nil {
+			return opts, err
+		}
+		values.Type = valueType
+	}
+	if str := get("nan"); str != "" {
+		policy, err := record.ParseNaNPolicy(str)
+		if err != nil {
+			return opts, err
+		}
+		values.NaN = policy
+	}
+	if str := get("scale"); str != "" {
+		scale, err := strconv.Atoi(str)
+		if err != nil {
+			return opts, fmt.Errorf("error: invalid `scale` parameter: %w", err)
+		}
+		values.Scale = scale
+	}
+	format := get("format")
+	if format == "" {
+		format = "default"
+	}
+	parser, err := record.NewParser(format, record.ParserOptions{
+		Key:    get("key"),
+		Value:  get("value"),
+		Header: get("header") == "true",
+		Values: values,
+	})
+	if err != nil {
+		return opts, err
+	}
+	opts.Values = values
+	opts.Parser = parser
+	return opts, nil
+}
+
+// localPath resolves the path of the server-local input, it can't leave the root
+func (s *Server) localPath(path string) (string, error) {
+	if s.config.Root == "" {
+		return "", fmt.Errorf("error: server-local inputs are disabled")
+	}
+	fpath := filepath.Join(s.config.Root, filepath.FromSlash(path))
+	rel, err := filepath.Rel(s.config.Root, fpath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("error: path %v is outside of the root", path)
+	}
+	if _, err := os.Stat(fpath); err != nil {
+		return "", fmt.Errorf("error: cannot read input %v", path)
+	}
+	return fpath, nil
+}
+
+// upload stores the request body in the temporary file
+func (s *Server) upload(w http.ResponseWriter, req *http.Request) (string, int, error) {
+	f, err := os.CreateTemp(s.config.UploadDir, "filereader-upload-*")
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	defer f.Close()
+	body := http.MaxBytesReader(w, req.Body, s.config.MaxUpload)
+	if _, err := io.Copy(f, body); err != nil {
+		os.Remove(f.Name())
+		if strings.Contains(err.Error(), "request body too large") {
+			return "", http.StatusRequestEntityTooLarge, fmt.Errorf("error: input is larger than %v bytes", s.config.MaxUpload)
+		}
+		return "", http.StatusBadRequest, fmt.Errorf("error: cannot read input: %w", err)
+	}
+	return f.Name(), 0, nil
+}
+
+func (s *Server) createJob(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	opts, err := s.jobParams(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var fpath, uploaded string
+	if path := query.Get("path"); path != "" {
+		fpath, err = s.localPath(path)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		var code int
+		fpath, code, err = s.upload(w, req)
+		if err != nil {
+			writeError(w, code, err)
+			return
+		}
+		uploaded = fpath
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		status: StatusQueued,
+		values: opts.Values,
+		cancel: cancel,
+	}
+	opts.OnProgress = func(p ranker.Progress) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j.progress = p
+	}
+	// the lock is held, so the job can't be looked up before it's fully created
+	s.mu.Lock()
+	id, err := submitJob(s.pool, ctx, []string{fpath}, opts)
+	if err != nil {
+		s.mu.Unlock()
+		cancel()
+		if uploaded != "" {
+			os.Remove(uploaded)
+		}
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	j.id = strconv.FormatUint(uint64(id), 10)
+	j.poolID = id
+	s.jobs[j.id] = j
+	s.wg.Add(1)
+	resp := s.status(j)
+	s.mu.Unlock()
+	go s.wait(j, uploaded)
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// wait takes results of the job from the pool once it's finished, and forgets the job after `JobTTL`
+func (s *Server) wait(j *job, uploaded string) {
+	defer s.wg.Done()
+	defer j.cancel()
+	if uploaded != "" {
+		defer os.Remove(uploaded)
+	}
+	records, stats, err := s.pool.Result(context.Background(), j.poolID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.records, j.stats, j.err = records, stats, err
+	j.finished = time.Now()
+	if stats != nil {
+		// the job could finish between status requests, so its start is never seen by them
+		j.started = j.finished.Add(-stats.WallTime)
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.status = StatusCancelled
+	case err != nil:
+		j.status = StatusFailed
+	default:
+		j.status = StatusDone
+	}
+	j.expiry = time.AfterFunc(s.config.JobTTL, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.jobs[j.id] == j {
+			delete(s.jobs, j.id)
+		}
+	})
+}
+
+func (s *Server) job(id string) (*job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	return j, ok
+}
+
+// jobStatusResponse describes the job, elapsed time is counted since the job is started
+type jobStatusResponse struct {
+	ID        string           `json:"id"`
+	Status    string           `json:"status"`
+	Error     string           `json:"error,omitempty"`
+	ElapsedMs int64            `json:"elapsed_ms"`
+	Malformed int64            `json:"malformed"`
+	Progress  progressResponse `json:"progress"`
+}
+
+// progressResponse describes progress of the job, total size is zero if it's unknown
+type progressResponse struct {
+	Percent         float64 `json:"percent"`
+	BytesDone       int64   `json:"bytes_done"`
+	TotalBytes      int64   `json:"total_bytes"`
+	Lines           int64   `json:"lines"`
+	SegmentsEmitted int64   `json:"segments_emitted"`
+	SegmentsDone    int64   `json:"segments_done"`
+}
+
+// status describes the job, it should be called with the lock held
+func (s *Server) status(j *job) jobStatusResponse {
+	if j.status == StatusQueued {
+		// the job is started by the pool, status of the unfinished job is refreshed from there
+		if st, err := s.pool.Status(j.poolID); err == nil && st.State != ranker.JobQueued {
+			j.status = StatusRunning
+			j.started = st.Started
+		}
+	}
+	resp := jobStatusResponse{ID: j.id, Status: j.status}
+	if j.err != nil {
+		resp.Error = j.err.Error()
+	}
+	if !j.started.IsZero() {
+		end := j.finished
+		if end.IsZero() {
+			end = time.Now()
+		}
+		resp.ElapsedMs = end.Sub(j.started).Milliseconds()
+	}
+	if j.stats != nil {
+		resp.Malformed = j.stats.Malformed
+	}
+	resp.Progress = progressResponse{
+		Percent:         j.progress.Percent(),
+		BytesDone:       j.progress.BytesDone,
+		TotalBytes:      j.progress.TotalBytes,
+		Lines:           j.progress.Lines,
+		SegmentsEmitted: j.progress.SegmentsEmitted,
+		SegmentsDone:    j.progress.SegmentsDone,
+	}
+	return resp
+}
+
+func (s *Server) jobStatus(w http.ResponseWriter, id string) {
+	j, ok := s.job(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("error: unknown job %v", id))
+		return
+	}
+	s.mu.Lock()
+	resp := s.status(j)
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type recordResponse struct {
+	Url   string      `json:"url"`
+	Value interface{} `json:"value"`
+}
+
+type jobResultResponse struct {
+	ID      string           `json:"id"`
+	Records []recordResponse `json:"records"`
+}
+
+func (s *Server) jobResult(w http.ResponseWriter, id string) {
+	j, ok := s.job(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("error: unknown job %v", id))
+		return
+	}
+	s.mu.Lock()
+	status, err, records := j.status, j.err, j.records
+	s.mu.Unlock()
+	switch status {
+	case StatusDone:
+	case StatusFailed, StatusCancelled:
+		writeError(w, http.StatusConflict, fmt.Errorf("error: job %v is %v: %w", id, status, err))
+		return
+	default:
+		writeError(w, http.StatusConflict, fmt.Errorf("error: job %v is %v", id, status))
+		return
+	}
+	resp := jobResultResponse{ID: id, Records: make([]recordResponse, len(records))}
+	for i, rec := range records {
+		resp.Records[i] = recordResponse{Url: rec.Url, Value: jsonValue(rec, j.values)}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// jsonValue formats the value as a JSON number, NaN and infinite values are formatted as strings
+func jsonValue(rec record.Record, values record.ValueFormat) interface{} {
+	if values.Type == record.ValueFloat && (math.IsNaN(rec.Float) || math.IsInf(rec.Float, 0)) {
+		return values.Format(rec)
+	}
+	return json.Number(values.Format(rec))
+}
+
+func (s *Server) deleteJob(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	delete(s.jobs, id)
+	if ok && j.expiry != nil {
+		j.expiry.Stop()
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("error: unknown job %v", id))
+		return
+	}
+	j.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gasparian/clickhouse-test-file-reader/internal/ranker"
+	"github.com/gasparian/clickhouse-test-file-reader/internal/record"
+)
+
+func newTestServer(t *testing.T, config Config) (*httptest.Server, string) {
+	root := t.TempDir()
+	var data strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&data, "http://api.tech.com/item/%v  %v\n", i, (i*37)%1000)
+	}
+	if err := os.WriteFile(filepath.Join(root, "input"), []byte(data.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.Root = root
+	config.UploadDir = t.TempDir()
+	s := New(config)
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+	})
+	return ts, root
+}
+
+func request(t *testing.T, method, url, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// waitStatus polls the job until it gets the status
+func waitStatus(t *testing.T, url, id, status string) jobStatusResponse {
+	var resp jobStatusResponse
+	for i := 0; i < 1000; i++ {
+		if code := request(t, http.MethodGet, url+"/jobs/"+id, "", &resp); code != http.StatusOK {
+			t.Fatalf("Expected status %v but got %v", http.StatusOK, code)
+		}
+		if resp.Status == status {
+			return resp
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected job %v to be %v but got %v", id, status, resp)
+	return resp
+}
+
+func TestServerJobs(t *testing.T) {
+	ts, root := newTestServer(t, Config{MaxJobs: 2})
+	gt, err := ranker.ProcessFiles(context.Background(), []string{filepath.Join(root, "input")},
+		ranker.Options{BufSize: 64, NWorkers: 1, TopK: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := "url,value\n" + strings.ReplaceAll(string(data), "  ", ",")
+	cases := map[string]struct {
+		query string
+		body  string
+	}{
+		"path":   {"path=input&k=3&workers=2&segment=256&buf=64", ""},
+		"upload": {"k=3&segment=256&buf=64", string(data)},
+		"csv":    {"k=3&format=csv&key=url&value=value", csv},
+	}
+	for name, c := range cases {
+		var created jobStatusResponse
+		if code := request(t, http.MethodPost, ts.URL+"/jobs?"+c.query, c.body, &created); code != http.StatusAccepted {
+			t.Fatalf("%v: expected status %v but got %v", name, http.StatusAccepted, code)
+		}
+		status := waitStatus(t, ts.URL, created.ID, StatusDone)
+		if status.Progress.Percent != 100 || status.Progress.SegmentsDone != status.Progress.SegmentsEmitted {
+			t.Fatalf("%v: expected the whole input to be processed, but got %+v", name, status.Progress)
+		}
+		var result jobResultResponse
+		if code := request(t, http.MethodGet, ts.URL+"/jobs/"+created.ID+"/result", "", &result); code != http.StatusOK {
+			t.Fatalf("%v: expected status %v but got %v", name, http.StatusOK, code)
+		}
+		if len(result.Records) != len(gt) {
+			t.Fatalf("%v: expected %v records but got %v", name, len(gt), result.Records)
+		}
+		for i, rec := range result.Records {
+			if rec.Url != gt[i].Url || fmt.Sprint(rec.Value) != fmt.Sprint(gt[i].Value) {
+				t.Fatalf("%v: expected `%v` but got `%v`", name, gt[i], rec)
+			}
+		}
+		if code := request(t, http.MethodDelete, ts.URL+"/jobs/"+created.ID, "", nil); code != http.StatusNoContent {
+			t.Fatalf("%v: expected status %v but got %v", name, http.StatusNoContent, code)
+		}
+		if code := request(t, http.MethodGet, ts.URL+"/jobs/"+created.ID, "", &created); code != http.StatusNotFound {
+			t.Fatalf("%v: expected status %v but got %v", name, http.StatusNotFound, code)
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	if s := New(Config{}); s.config.MaxUpload != DefaultMaxUpload {
+		t.Fatalf("Expected default upload limit %v but got %v", DefaultMaxUpload, s.config.MaxUpload)
+	} else {
+		s.Close()
+	}
+	ts, _ := newTestServer(t, Config{MaxUpload: 10})
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodPost, "/jobs?path=../input", "", http.StatusBadRequest},
+		{http.MethodPost, "/jobs?path=missing", "", http.StatusBadRequest},
+		{http.MethodPost, "/jobs?path=input&k=0", "", http.StatusBadRequest},
+		{http.MethodPost, "/jobs?path=input&workers=x", "", http.StatusBadRequest},
+		{http.MethodPost, "/jobs?path=input&format=xml", "", http.StatusBadRequest},
+		{http.MethodPost, "/jobs?path=input&nan=x", "", http.StatusBadRequest},
+		{http.MethodPost, "/jobs", strings.Repeat("a", 11), http.StatusRequestEntityTooLarge},
+		{http.MethodGet, "/jobs/1", "", http.StatusNotFound},
+		{http.MethodGet, "/jobs/1/result", "", http.StatusNotFound},
+		{http.MethodDelete, "/jobs/1", "", http.StatusNotFound},
+		{http.MethodGet, "/tasks", "", http.StatusNotFound},
+		{http.MethodPut, "/jobs", "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		var resp map[string]string
+		if code := request(t, c.method, ts.URL+c.path, c.body, &resp); code != c.code || resp["error"] == "" {
+			t.Fatalf("%v %v: expected status %v with error but got %v: %v", c.method, c.path, c.code, code, resp)
+		}
+	}
+	// failed job is reported by its status and result
+	var created jobStatusResponse
+	request(t, http.MethodPost, ts.URL+"/jobs?path=input&buf=1024&segment=64", "", &created)
+	status := waitStatus(t, ts.URL, created.ID, StatusFailed)
+	var resp map[string]string
+	if code := request(t, http.MethodGet, ts.URL+"/jobs/"+created.ID+"/result", "", &resp); code != http.StatusConflict || status.Error == "" {
+		t.Fatalf("Expected status %v with error but got %v: %v", http.StatusConflict, code, status)
+	}
+}
+
+// blockingParser blocks parsing until the job is cancelled or released
+type blockingParser struct {
+	record.Parser
+	ctx     context.Context
+	release chan struct{}
+}
+
+func (p blockingParser) Parse(line string) (record.Record, error) {
+	select {
+	case <-p.ctx.Done():
+	case <-p.release:
+	}
+	return p.Parser.Parse(line)
+}
+
+func TestServerConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	submitJob = func(p *ranker.Pool, ctx context.Context, fpaths []string, opts ranker.Options) (ranker.JobID, error) {
+		opts.Parser = blockingParser{opts.Parser, ctx, release}
+		return p.Submit(ctx, fpaths, opts)
+	}
+	defer func() { submitJob = (*ranker.Pool).Submit }()
+	ts, _ := newTestServer(t, Config{MaxJobs: 1})
+	ids := make([]string, 3)
+	for i := range ids {
+		var created jobStatusResponse
+		request(t, http.MethodPost, ts.URL+"/jobs?path=input", "", &created)
+		ids[i] = created.ID
+	}
+	waitStatus(t, ts.URL, ids[0], StatusRunning)
+	for _, id := range ids[1:] {
+		waitStatus(t, ts.URL, id, StatusQueued)
+	}
+	var resp map[string]string
+	if code := request(t, http.MethodGet, ts.URL+"/jobs/"+ids[1]+"/result", "", &resp); code != http.StatusConflict {
+		t.Fatalf("Expected status %v but got %v", http.StatusConflict, code)
+	}
+	// cancelled running job frees the pool for the next one
+	if code := request(t, http.MethodDelete, ts.URL+"/jobs/"+ids[0], "", nil); code != http.StatusNoContent {
+		t.Fatalf("Expected status %v but got %v", http.StatusNoContent, code)
+	}
+	waitStatus(t, ts.URL, ids[1], StatusRunning)
+	waitStatus(t, ts.URL, ids[2], StatusQueued)
+	close(release)
+	waitStatus(t, ts.URL, ids[1], StatusDone)
+	waitStatus(t, ts.URL, ids[2], StatusDone)
+}
+
+func TestServerElapsed(t *testing.T) {
+	release := make(chan struct{})
+	submitJob = func(p *ranker.Pool, ctx context.Context, fpaths []string, opts ranker.Options) (ranker.JobID, error) {
+		opts.Parser = blockingParser{opts.Parser, ctx, release}
+		return p.Submit(ctx, fpaths, opts)
+	}
+	defer func() { submitJob = (*ranker.Pool).Submit }()
+	ts, _ := newTestServer(t, Config{})
+	var created jobStatusResponse
+	request(t, http.MethodPost, ts.URL+"/jobs?path=input", "", &created)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	// status isn't requested until the job is finished
+	var result jobResultResponse
+	for i := 0; request(t, http.MethodGet, ts.URL+"/jobs/"+created.ID+"/result", "", &result) != http.StatusOK; i++ {
+		if i == 1000 {
+			t.Fatalf("Expected job %v to finish", created.ID)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	status := waitStatus(t, ts.URL, created.ID, StatusDone)
+	if status.ElapsedMs < 20 {
+		t.Fatalf("Expected elapsed time of at least 20ms but got %v", status.ElapsedMs)
+	}
+}
+
+func TestServerJobTTL(t *testing.T) {
+	ts, _ := newTestServer(t, Config{JobTTL: 10 * time.Millisecond})
+	var created jobStatusResponse
+	request(t, http.MethodPost, ts.URL+"/jobs?path=input", "", &created)
+	var resp map[string]interface{}
+	for i := 0; i < 1000; i++ {
+		if code := request(t, http.MethodGet, ts.URL+"/jobs/"+created.ID, "", &resp); code == http.StatusNotFound {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected finished job %v to be forgotten but got %v", created.ID, resp)
+}
+
+func TestServerNaNParam(t *testing.T) {
+	ts, _ := newTestServer(t, Config{})
+	body := "http://api.tech.com/item/1  1.5\nhttp://api.tech.com/item/2  NaN\nhttp://api.tech.com/item/3  +Inf\n"
+	cases := []struct {
+		query string
+		gt    []string
+	}{
+		{"valuetype=float&k=3", []string{"http://api.tech.com/item/1"}},
+		{"valuetype=float&k=3&nan=lowest", []string{"http://api.tech.com/item/3", "http://api.tech.com/item/1", "http://api.tech.com/item/2"}},
+		{"valuetype=float&k=3&nan=highest", []string{"http://api.tech.com/item/2", "http://api.tech.com/item/3", "http://api.tech.com/item/1"}},
+	}
+	for _, c := range cases {
+		var created jobStatusResponse
+		if code := request(t, http.MethodPost, ts.URL+"/jobs?"+c.query, body, &created); code != http.StatusAccepted {
+			t.Fatalf("%v: expected status %v but got %v", c.query, http.StatusAccepted, code)
+		}
+		waitStatus(t, ts.URL, created.ID, StatusDone)
+		var result jobResultResponse
+		request(t, http.MethodGet, ts.URL+"/jobs/"+created.ID+"/result", "", &result)
+		urls := make([]string, len(result.Records))
+		for i, rec := range result.Records {
+			urls[i] = rec.Url
+		}
+		if fmt.Sprint(urls) != fmt.Sprint(c.gt) {
+			t.Fatalf("%v: expected %v but got %v", c.query, c.gt, urls)
+		}
+	}
+	var resp map[string]string
+	if code := request(t, http.MethodPost, ts.URL+"/jobs?valuetype=float&nan=middle", body, &resp); code != http.StatusBadRequest {
+		t.Fatalf("Expected status %v but got %v", http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,40 @@
+// Package testutil holds helpers shared by tests of several packages
+package testutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+)
+
+// WriteBGZFBlock compresses data into a single BGZF block
+func WriteBGZFBlock(t testing.TB, out *bytes.Buffer, data []byte) {
+	var block bytes.Buffer
+	w := gzip.NewWriter(&block)
+	w.Header.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := block.Bytes()
+	// BSIZE is the total block size minus 1, it follows fixed header, XLEN and subfield header
+	binary.LittleEndian.PutUint16(b[16:18], uint16(len(b)-1))
+	out.Write(b)
+}
+
+// WriteBGZF compresses data into BGZF blocks of `blockSize` uncompressed bytes followed by the empty EOF block
+func WriteBGZF(t testing.TB, data []byte, blockSize int) []byte {
+	var out bytes.Buffer
+	for start := 0; start < len(data); start += blockSize {
+		end := start + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		WriteBGZFBlock(t, &out, data[start:end])
+	}
+	WriteBGZFBlock(t, &out, nil)
+	return out.Bytes()
+}
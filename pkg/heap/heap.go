@@ -1,5 +1,7 @@
 package heap
 
+import "sort"
+
 // Ref.: https://gist.github.com/nwillc/554847806891a41e7bd32041308dfb40#file-go_generics_heap-go
 
 // InvertedBoundedHeap holds generic heap implementation
@@ -24,34 +26,148 @@ func NewHeap[T any](comp func(a, b T) bool, maxSize int, data []T) *InvertedBoun
 // Len returns size of InvertedBoundedHeap
 func (h *InvertedBoundedHeap[T]) Len() int { return len(h.data) }
 
+// Peek returns top element of InvertedBoundedHeap without removing it, `false` is returned for the empty heap
+func (h *InvertedBoundedHeap[T]) Peek() (T, bool) {
+	if h.Len() == 0 {
+		var v T
+		return v, false
+	}
+	return h.data[0], true
+}
+
 // Push adds new element to InvertedBoundedHeap
-// it will return value from the top of the heap if size limit exceeded (be careful!)
+// it will return value from the top of the heap if size limit exceeded (be careful!),
+// otherwise the zero value is returned; use PushPop to tell these cases apart
 func (h *InvertedBoundedHeap[T]) Push(v T) T {
-	h.data = append(h.data, v)
-	h.up(h.Len() - 1)
-	var v_ T
-	if h.Len() > h.maxSize {
-		v_ = h.Pop()
-	}
+	v_, _ := h.PushPop(v)
 	return v_
 }
 
+// PushPop adds new element and, if the size limit is exceeded, removes the top one in a single step;
+// evicted element is returned with `true`, it's the new element itself if it goes on top
+func (h *InvertedBoundedHeap[T]) PushPop(v T) (T, bool) {
+	if h.Len() < h.maxSize {
+		h.data = append(h.data, v)
+		h.up(h.Len() - 1)
+		var v_ T
+		return v_, false
+	}
+	if h.Len() == 0 || h.comp(v, h.data[0]) {
+		return v, true
+	}
+	return h.Replace(v)
+}
+
+// Replace removes the top element and adds the new one in a single step, regardless of their order;
+// removed element is returned with `true`, or `false` if the heap is empty
+func (h *InvertedBoundedHeap[T]) Replace(v T) (T, bool) {
+	if h.Len() == 0 {
+		h.data = append(h.data, v)
+		var v_ T
+		return v_, false
+	}
+	top := h.data[0]
+	h.data[0] = v
+	h.down(h.Len())
+	return top, true
+}
+
 // Pop removes and returns top element from InvertedBoundedHeap
 func (h *InvertedBoundedHeap[T]) Pop() T {
 	n := h.Len() - 1
 	if n > 0 {
 		h.swap(0, n)
-		h.down()
+		h.down(n)
 	}
 	v := h.data[n]
 	h.data = h.data[0:n]
 	return v
 }
 
-// Merge merges current heap with the provided one
+// Sorted returns copy of elements in rank order, from the bottom of the heap to the top one,
+// the heap itself is not changed
+func (h *InvertedBoundedHeap[T]) Sorted() []T {
+	sorted := h.Items()
+	sort.Slice(sorted, func(i, j int) bool {
+		return h.comp(sorted[j], sorted[i])
+	})
+	return sorted
+}
+
+// Drain removes all elements and returns them in rank order, from the bottom of the heap to the top one
+func (h *InvertedBoundedHeap[T]) Drain() []T {
+	n := h.Len()
+	drained := make([]T, n)
+	for i := n - 1; i >= 0; i-- {
+		drained[i] = h.Pop()
+	}
+	return drained
+}
+
+// Items returns copy of elements in the heap order
+func (h *InvertedBoundedHeap[T]) Items() []T {
+	return append([]T{}, h.data...)
+}
+
+// Iter returns iterator over elements in the heap order;
+// heap shouldn't be modified until iteration is finished
+func (h *InvertedBoundedHeap[T]) Iter() *Iterator[T] {
+	return &Iterator[T]{data: h.data, i: -1}
+}
+
+// Clear removes all elements, keeping the allocated memory for reuse
+func (h *InvertedBoundedHeap[T]) Clear() {
+	var zero T
+	for i := range h.data {
+		// release references held by the elements
+		h.data[i] = zero
+	}
+	h.data = h.data[:0]
+}
+
+// Reset removes all elements and releases the allocated memory
+func (h *InvertedBoundedHeap[T]) Reset() {
+	h.data = nil
+}
+
+// MaxSize returns the size limit of the heap
+func (h *InvertedBoundedHeap[T]) MaxSize() int { return h.maxSize }
+
+// SetMaxSize changes the size limit, elements above the new limit are removed from the top and returned
+func (h *InvertedBoundedHeap[T]) SetMaxSize(maxSize int) []T {
+	h.maxSize = maxSize
+	var evicted []T
+	for h.Len() > h.maxSize {
+		evicted = append(evicted, h.Pop())
+	}
+	return evicted
+}
+
+// Merge merges current heap with the provided one, which is left unchanged;
+// elements which don't fit into the heap are returned
 func (h *InvertedBoundedHeap[T]) Merge(inputHeap *InvertedBoundedHeap[T]) []T {
-	h.data = append(h.data, inputHeap.data...)
-	return h.build()
+	evicted := make([]T, 0)
+	h.MergeFunc(inputHeap, func(v T) {
+		evicted = append(evicted, v)
+	})
+	return evicted
+}
+
+// MergeFunc merges current heap with the provided one, which is left unchanged: once the heap is full,
+// only elements which beat its top are pushed, so merging costs O(n) comparisons plus O(log k)
+// per element which gets into the heap; `evicted` is called with elements which don't fit, if it's set.
+// Both heaps should use the same comparator
+func (h *InvertedBoundedHeap[T]) MergeFunc(inputHeap *InvertedBoundedHeap[T], evicted func(T)) {
+	if h.Len() == 0 && inputHeap.Len() <= h.maxSize {
+		// input is a valid heap already
+		h.data = append(h.data, inputHeap.data...)
+		return
+	}
+	for _, v := range inputHeap.data {
+		if v_, ok := h.PushPop(v); ok && evicted != nil {
+			evicted(v_)
+		}
+	}
 }
 
 func (h *InvertedBoundedHeap[T]) swap(i, j int) {
@@ -69,8 +185,8 @@ func (h *InvertedBoundedHeap[T]) up(jj int) {
 	}
 }
 
-func (h *InvertedBoundedHeap[T]) down() {
-	n := h.Len() - 1
+// down sifts the top element down among the first `n` elements
+func (h *InvertedBoundedHeap[T]) down(n int) {
 	i1 := 0
 	for {
 		j1 := left(i1)
@@ -122,3 +238,27 @@ func (h *InvertedBoundedHeap[T]) build() []T {
 func parent(i int) int { return (i - 1) / 2 }
 func left(i int) int   { return (i * 2) + 1 }
 func right(i int) int  { return left(i) + 1 }
+
+// Iterator iterates over elements of the heap, e.g.:
+//
+//	for it := h.Iter(); it.Next(); {
+//		v := it.Value()
+//	}
+type Iterator[T any] struct {
+	data []T
+	i    int
+}
+
+// Next advances iterator to the next element, `false` is returned when there are no more elements
+func (it *Iterator[T]) Next() bool {
+	if it.i+1 >= len(it.data) {
+		return false
+	}
+	it.i++
+	return true
+}
+
+// Value returns the current element
+func (it *Iterator[T]) Value() T {
+	return it.data[it.i]
+}
@@ -1,6 +1,7 @@
 package heap
 
 import (
+	"math/rand"
 	"sort"
 	"testing"
 )
@@ -27,6 +28,23 @@ func TestMinInvertedHeap(t *testing.T) {
 	}
 }
 
+func TestPeek(t *testing.T) {
+	h := NewHeap(func(a, b int) bool { return a < b }, 2, nil)
+	if _, ok := h.Peek(); ok {
+		t.Fatal("Expected empty heap")
+	}
+	h.Push(5)
+	h.Push(3)
+	h.Push(7)
+	v, ok := h.Peek()
+	if !ok || v != 5 {
+		t.Fatalf("Expected: %v, but got: %v\n", 5, v)
+	}
+	if h.Len() != 2 {
+		t.Fatalf("Expected: %v, but got: %v\n", 2, h.Len())
+	}
+}
+
 func TestMinInvertedHeapFromSlice(t *testing.T) {
 	data := []int{1, 3, 0, 2, 12, 10}
 	trueOrder := make([]int, len(data))
@@ -137,3 +155,215 @@ func TestMergeMaxInvertedHeapsBoundedSmallPush(t *testing.T) {
 		}
 	}
 }
+
+func TestMergeMinInvertedHeapsBoundedSmall(t *testing.T) {
+	data := []int{9, 350, 25, 231, 111}
+	trueOrder := []int{9, 25}
+	maxSize := 2
+	comp := func(a, b int) bool { return a > b }
+	h1 := NewHeap(comp, maxSize, data[:2])
+	h2 := NewHeap(comp, maxSize, data[2:4])
+	h3 := NewHeap(comp, maxSize, data[4:])
+	h1.Merge(h2)
+	h1.Merge(h3)
+	// 3 highest values has been dropped during the merge
+	for i := maxSize - 1; i >= 0; i-- {
+		v := h1.Pop()
+		if v != trueOrder[i] {
+			t.Fatalf("Expected: %v, but got: %v\n", trueOrder[i], v)
+		}
+	}
+}
+
+func TestPushPop(t *testing.T) {
+	h := NewHeap(func(a, b int) bool { return a < b }, 2, nil)
+	if _, ok := h.PushPop(0); ok {
+		t.Fatal("Nothing should be evicted from the heap below the limit")
+	}
+	h.PushPop(5)
+	v, ok := h.PushPop(-1)
+	if !ok || v != -1 {
+		t.Fatalf("Expected: %v, but got: %v\n", -1, v)
+	}
+	v, ok = h.PushPop(3)
+	if !ok || v != 0 {
+		t.Fatalf("Expected: %v, but got: %v\n", 0, v)
+	}
+	if sorted := h.Sorted(); len(sorted) != 2 || sorted[0] != 5 || sorted[1] != 3 {
+		t.Fatalf("Expected: %v, but got: %v\n", []int{5, 3}, sorted)
+	}
+	empty := NewHeap(func(a, b int) bool { return a < b }, 0, nil)
+	if v, ok := empty.PushPop(1); !ok || v != 1 || empty.Len() != 0 {
+		t.Fatalf("Expected: %v, but got: %v\n", 1, v)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	h := NewHeap(func(a, b int) bool { return a < b }, 3, nil)
+	if _, ok := h.Replace(4); ok {
+		t.Fatal("Nothing should be replaced in the empty heap")
+	}
+	h.Push(7)
+	h.Push(5)
+	v, ok := h.Replace(1)
+	if !ok || v != 4 {
+		t.Fatalf("Expected: %v, but got: %v\n", 4, v)
+	}
+	if top, _ := h.Peek(); top != 1 {
+		t.Fatalf("Expected: %v, but got: %v\n", 1, top)
+	}
+	v, _ = h.Replace(9)
+	if top, _ := h.Peek(); v != 1 || top != 5 {
+		t.Fatalf("Expected: %v and %v on top, but got: %v and %v\n", 1, 5, v, top)
+	}
+}
+
+func TestSortedAndDrain(t *testing.T) {
+	data := []int{1, 3, 0, 2, 12, 10}
+	h := NewHeap(func(a, b int) bool { return a > b }, 4, nil)
+	for _, v := range data {
+		h.Push(v)
+	}
+	gt := []int{0, 1, 2, 3}
+	for i := 0; i < 2; i++ {
+		sorted := h.Sorted()
+		if len(sorted) != len(gt) || h.Len() != len(gt) {
+			t.Fatalf("Expected: %v, but got: %v\n", gt, sorted)
+		}
+		for i := range gt {
+			if sorted[i] != gt[i] {
+				t.Fatalf("Expected: %v, but got: %v\n", gt, sorted)
+			}
+		}
+	}
+	items := make(map[int]bool)
+	for it := h.Iter(); it.Next(); {
+		items[it.Value()] = true
+	}
+	if len(items) != len(gt) || len(h.Items()) != len(gt) {
+		t.Fatalf("Expected: %v, but got: %v\n", gt, items)
+	}
+	for _, v := range gt {
+		if !items[v] {
+			t.Fatalf("Expected: %v, but got: %v\n", gt, items)
+		}
+	}
+	drained := h.Drain()
+	if h.Len() != 0 || len(drained) != len(gt) || drained[0] != 0 || drained[3] != 3 {
+		t.Fatalf("Expected: %v, but got: %v\n", gt, drained)
+	}
+}
+
+func TestClearAndMaxSize(t *testing.T) {
+	h := NewHeap(func(a, b int) bool { return a < b }, 5, []int{4, 2, 8, 6, 1})
+	evicted := h.SetMaxSize(3)
+	if h.MaxSize() != 3 || len(evicted) != 2 || evicted[0] != 1 || evicted[1] != 2 {
+		t.Fatalf("Expected: %v, but got: %v\n", []int{1, 2}, evicted)
+	}
+	h.Clear()
+	if h.Len() != 0 || h.Iter().Next() {
+		t.Fatalf("Expected: %v, but got: %v\n", 0, h.Len())
+	}
+	h.Push(3)
+	h.Reset()
+	if _, ok := h.Peek(); ok {
+		t.Fatal("Expected empty heap")
+	}
+	h.SetMaxSize(1)
+	h.Push(1)
+	if v, ok := h.PushPop(2); !ok || v != 1 {
+		t.Fatalf("Expected: %v, but got: %v\n", 1, v)
+	}
+}
+
+// randomHeaps generates n heaps of random sizes up to k and returns them with the k best elements of all heaps
+func randomHeaps(rnd *rand.Rand, n, k int) ([]*InvertedBoundedHeap[int], []int) {
+	comp := func(a, b int) bool { return a < b }
+	heaps := make([]*InvertedBoundedHeap[int], n)
+	all := make([]int, 0)
+	for i := range heaps {
+		heaps[i] = NewHeap(comp, k, nil)
+		size := rnd.Intn(k + 1)
+		for j := 0; j < size; j++ {
+			v := rnd.Intn(10 * k)
+			heaps[i].Push(v)
+			all = append(all, v)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] > all[j] })
+	if len(all) > k {
+		all = all[:k]
+	}
+	return heaps, all
+}
+
+func TestMergeFunc(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	for _, k := range []int{1, 5, 100} {
+		heaps, gt := randomHeaps(rnd, 50, k)
+		h := NewHeap(heaps[0].comp, k, nil)
+		nEvicted := 0
+		total := 0
+		for _, input := range heaps {
+			total += input.Len()
+			h.MergeFunc(input, func(int) { nEvicted++ })
+		}
+		if h.Len()+nEvicted != total {
+			t.Fatalf("Expected: %v elements kept or evicted, but got: %v\n", total, h.Len()+nEvicted)
+		}
+		sorted := h.Sorted()
+		for i := range gt {
+			if sorted[i] != gt[i] {
+				t.Fatalf("Expected: %v, but got: %v\n", gt, sorted)
+			}
+		}
+	}
+}
+
+// benchmarkMerge merges 10k full heaps of size k, as produced by workers for a file of 10k segments
+func benchmarkMerge(b *testing.B, merge func([]*InvertedBoundedHeap[int]) *InvertedBoundedHeap[int]) {
+	rnd := rand.New(rand.NewSource(42))
+	n, k := 10000, 1000
+	comp := func(a, b int) bool { return a < b }
+	data := make([][]int, n)
+	for i := range data {
+		data[i] = make([]int, k)
+		for j := range data[i] {
+			data[i][j] = rnd.Int()
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		heaps := make([]*InvertedBoundedHeap[int], n)
+		for j := range heaps {
+			heaps[j] = NewHeap(comp, k, data[j])
+		}
+		b.StartTimer()
+		if h := merge(heaps); h.Len() != k {
+			b.Fatalf("Expected: %v, but got: %v\n", k, h.Len())
+		}
+	}
+}
+
+// BenchmarkMergeRebuild merges heaps by appending all elements and rebuilding the heap
+func BenchmarkMergeRebuild(b *testing.B) {
+	benchmarkMerge(b, func(heaps []*InvertedBoundedHeap[int]) *InvertedBoundedHeap[int] {
+		h := NewHeap(heaps[0].comp, heaps[0].maxSize, nil)
+		for _, input := range heaps {
+			h.data = append(h.data, input.data...)
+			h.build()
+		}
+		return h
+	})
+}
+
+func BenchmarkMergeFunc(b *testing.B) {
+	benchmarkMerge(b, func(heaps []*InvertedBoundedHeap[int]) *InvertedBoundedHeap[int] {
+		h := NewHeap(heaps[0].comp, heaps[0].maxSize, nil)
+		for _, input := range heaps {
+			h.MergeFunc(input, nil)
+		}
+		return h
+	})
+}